@@ -0,0 +1,167 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/teamnsrg/zcrypto/ct"
+)
+
+// merkleTreeLeafInput serializes the MerkleTreeLeaf of an entry, i.e. the
+// leaf_input returned by get-entries, whose hash is the Merkle tree leaf.
+func merkleTreeLeafInput(leaf *ct.MerkleTreeLeaf) []byte {
+	var buf bytes.Buffer
+	putUint := func(v uint64, n int) {
+		for i := n - 1; i >= 0; i-- {
+			buf.WriteByte(byte(v >> (8 * uint(i))))
+		}
+	}
+	putVector := func(v []byte, n int) {
+		putUint(uint64(len(v)), n)
+		buf.Write(v)
+	}
+	entry := &leaf.TimestampedEntry
+	putUint(uint64(leaf.Version), 1)
+	putUint(uint64(leaf.LeafType), 1)
+	putUint(entry.Timestamp, 8)
+	putUint(uint64(entry.EntryType), 2)
+	if entry.EntryType == ct.PrecertLogEntryType {
+		buf.Write(entry.PrecertEntry.IssuerKeyHash[:])
+		putVector(entry.PrecertEntry.TBSCertificate, 3)
+	} else {
+		putVector(entry.X509Entry, 3)
+	}
+	putVector(entry.Extensions, 2)
+	return buf.Bytes()
+}
+
+// logAuditor recomputes a log's Merkle tree over the entries we download so
+// that a finished download can be checked against the log's signed root.
+// Entries arrive out of order from the scanner's workers and are held until
+// the tree can be extended with them.
+type logAuditor struct {
+	sync.Mutex
+	tree    compactRange
+	pending map[int64][]byte
+}
+
+// newLogAuditor resumes the audit stored for l. The stored range may be ahead
+// of l.LastIndex, or behind it while the next entry it needs is in a gap still
+// being retried, with the entries downloaded past the gap pending.
+func newLogAuditor(l CTLogInfo) (*logAuditor, error) {
+	if auditBlocked(l, l.AuditTreeSize) {
+		return nil, fmt.Errorf("audit stopped at %d but sync is at %d; resync from 0 to audit", l.AuditTreeSize, l.LastIndex)
+	}
+	a := &logAuditor{pending: make(map[int64][]byte)}
+	hashes, err := base64.StdEncoding.DecodeString(l.AuditHashes)
+	if err != nil || len(hashes)%32 != 0 {
+		return nil, fmt.Errorf("stored audit hashes are corrupt")
+	}
+	for len(hashes) > 0 {
+		a.tree.hashes = append(a.tree.hashes, hashes[:32])
+		hashes = hashes[32:]
+	}
+	a.tree.size = l.AuditTreeSize
+	pending, err := base64.StdEncoding.DecodeString(l.AuditPending)
+	if err != nil || len(pending)%40 != 0 {
+		return nil, fmt.Errorf("stored pending audit hashes are corrupt")
+	}
+	for ; len(pending) > 0; pending = pending[40:] {
+		a.pending[int64(binary.BigEndian.Uint64(pending[:8]))] = pending[8:40]
+	}
+	return a, nil
+}
+
+// auditBlocked reports whether the entry at next, the one the audit needs to
+// go on, will never be downloaded: it is below LastIndex and in no gap that
+// is still retried.
+func auditBlocked(l CTLogInfo, next int64) bool {
+	if next >= l.LastIndex {
+		return false
+	}
+	for _, gap := range l.Gaps {
+		if !gap.Missing && gap.Start <= next && next < gap.End {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *logAuditor) add(entry *ct.LogEntry) {
+	a.addLeafInput(entry.Index, merkleTreeLeafInput(&entry.Leaf))
+}
+
+// addLeafInput adds the entry at index by its leaf_input, which is all there
+// is of an entry that does not parse.
+func (a *logAuditor) addLeafInput(index int64, leafInput []byte) {
+	a.Lock()
+	defer a.Unlock()
+	if index < a.tree.size {
+		return
+	}
+	a.pending[index] = leafHash(leafInput)
+	for {
+		hash, ok := a.pending[a.tree.size]
+		if !ok {
+			break
+		}
+		delete(a.pending, a.tree.size)
+		a.tree.append(hash)
+	}
+}
+
+func (a *logAuditor) size() int64 {
+	a.Lock()
+	defer a.Unlock()
+	return a.tree.size
+}
+
+// verify compares the recomputed root with the STH, which must be for the
+// tree size the auditor has reached.
+func (a *logAuditor) verify(sth *ct.SignedTreeHead) error {
+	a.Lock()
+	defer a.Unlock()
+	if a.tree.size != int64(sth.TreeSize) {
+		return fmt.Errorf("audited %d entries, STH is for %d", a.tree.size, sth.TreeSize)
+	}
+	if !bytes.Equal(a.tree.root(), sth.SHA256RootHash[:]) {
+		return &inconsistentLogError{fmt.Sprintf("recomputed root for tree size %d does not match STH", sth.TreeSize)}
+	}
+	return nil
+}
+
+func (a *logAuditor) save(l *CTLogInfo) {
+	a.Lock()
+	defer a.Unlock()
+	l.AuditTreeSize = a.tree.size
+	l.AuditHashes = base64.StdEncoding.EncodeToString(bytes.Join(a.tree.hashes, nil))
+	indices := make([]int64, 0, len(a.pending))
+	for index := range a.pending {
+		indices = append(indices, index)
+	}
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+	pending := make([]byte, 0, 40*len(indices))
+	for _, index := range indices {
+		pending = binary.BigEndian.AppendUint64(pending, uint64(index))
+		pending = append(pending, a.pending[index]...)
+	}
+	l.AuditPending = base64.StdEncoding.EncodeToString(pending)
+}
@@ -0,0 +1,161 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+)
+
+// bloomFilter is a Bloom filter over SHA-256 fingerprints. The keys are
+// already uniformly distributed, so the bit positions are derived from the
+// key itself by double hashing instead of hashing it again.
+type bloomFilter struct {
+	bits []uint64
+	m    uint64
+	k    uint64
+}
+
+// kMaxBloomBits keeps a filter within 16 GiB of memory.
+const kMaxBloomBits = 1 << 37
+
+// bloomFilterBits is the number of bits a filter for capacity keys at fpRate
+// needs. It rejects what would make a useless or unallocatable filter.
+func bloomFilterBits(capacity uint64, fpRate float64) (uint64, error) {
+	if capacity == 0 {
+		return 0, errors.New("-bloom-capacity must be positive")
+	}
+	// Written so that NaN fails too.
+	if !(fpRate > 0 && fpRate < 1) {
+		return 0, fmt.Errorf("-bloom-fp-rate must be between 0 and 1, not %v", fpRate)
+	}
+	m := math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	if m > kMaxBloomBits {
+		return 0, fmt.Errorf("a bloom filter for %d certificates at a false positive rate of %v needs %.0f GiB", capacity, fpRate, m/8/(1<<30))
+	}
+	return uint64(m), nil
+}
+
+func newBloomFilter(capacity uint64, fpRate float64) (*bloomFilter, error) {
+	m, err := bloomFilterBits(capacity, fpRate)
+	if err != nil {
+		return nil, err
+	}
+	k := uint64(math.Ceil(float64(m) / float64(capacity) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}, nil
+}
+
+func (f *bloomFilter) positions(key []byte, fn func(uint64)) {
+	h1 := binary.LittleEndian.Uint64(key[0:8])
+	h2 := binary.LittleEndian.Uint64(key[8:16]) | 1
+	for i := uint64(0); i < f.k; i++ {
+		fn((h1 + i*h2) % f.m)
+	}
+}
+
+func (f *bloomFilter) add(key []byte) {
+	f.positions(key, func(bit uint64) {
+		f.bits[bit/64] |= 1 << (bit % 64)
+	})
+}
+
+// mayContain is false only for keys that were never added.
+func (f *bloomFilter) mayContain(key []byte) bool {
+	res := true
+	f.positions(key, func(bit uint64) {
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			res = false
+		}
+	})
+	return res
+}
+
+var bloomFileMagic = [8]byte{'C', 'T', 'B', 'L', 'O', 'O', 'M', '2'}
+
+// bloomStamp ties a saved filter to the state of the backend it was saved
+// with.
+type bloomStamp [16]byte
+
+func (f *bloomFilter) save(path string, stamp bloomStamp) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for _, v := range []interface{}{bloomFileMagic, stamp, f.m, f.k, f.bits} {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadBloomFilter reads a filter written by save, and the stamp it was saved
+// with. It fails if the filter was sized differently than a filter for
+// capacity and fpRate would be.
+func loadBloomFilter(path string, capacity uint64, fpRate float64) (*bloomFilter, bloomStamp, error) {
+	var stamp bloomStamp
+	f, err := newBloomFilter(capacity, fpRate)
+	if err != nil {
+		return nil, stamp, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, stamp, err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	var magic [8]byte
+	var m, k uint64
+	for _, v := range []interface{}{&magic, &stamp, &m, &k} {
+		if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+			return nil, stamp, err
+		}
+	}
+	if magic != bloomFileMagic {
+		return nil, stamp, errors.New("not a bloom filter file")
+	}
+	if m != f.m || k != f.k {
+		return nil, stamp, fmt.Errorf("bloom filter was sized for different -bloom-capacity or -bloom-fp-rate (m=%d k=%d, want m=%d k=%d)", m, k, f.m, f.k)
+	}
+	if err := binary.Read(r, binary.LittleEndian, f.bits); err != nil {
+		return nil, stamp, err
+	}
+	return f, stamp, nil
+}
@@ -0,0 +1,68 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func testKey(i uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], i)
+	key := sha256.Sum256(buf[:])
+	return key[:]
+}
+
+func TestBloomFilter(t *testing.T) {
+	const n = 10000
+	f, err := newBloomFilter(n, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(0); i < n; i++ {
+		f.add(testKey(i))
+	}
+	for i := uint64(0); i < n; i++ {
+		if !f.mayContain(testKey(i)) {
+			t.Fatalf("key %d missing", i)
+		}
+	}
+	falsePositives := 0
+	for i := uint64(n); i < 2*n; i++ {
+		if f.mayContain(testKey(i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / n; rate > 0.02 {
+		t.Errorf("false positive rate %.4f, expected about 0.01", rate)
+	}
+}
+
+func TestBloomFilterOptions(t *testing.T) {
+	for _, fpRate := range []float64{0, 1, -0.5, 2, math.NaN()} {
+		if _, err := bloomFilterBits(1000, fpRate); err == nil {
+			t.Errorf("false positive rate %v accepted", fpRate)
+		}
+	}
+	if _, err := bloomFilterBits(0, 0.01); err == nil {
+		t.Error("zero capacity accepted")
+	}
+	if _, err := bloomFilterBits(1<<40, 0.01); err == nil {
+		t.Error("oversized filter accepted")
+	}
+}
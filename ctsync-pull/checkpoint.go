@@ -0,0 +1,227 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// kCheckpointLogName is the checkpoint log in a sink's directory.
+const kCheckpointLogName = ".ctsync-checkpoints"
+
+// kCheckpointLogRecords is how many records the log grows to before it is
+// rewritten as one.
+const kCheckpointLogRecords = 1000
+
+// committedFunc reports whether the dedup inserts up to a checkpoint were
+// committed.
+type committedFunc func(checkpoint string) (bool, error)
+
+// newCheckpointID names a checkpoint in the sinks' logs and the deduper.
+func newCheckpointID() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", fmt.Errorf("naming checkpoint: %s", err)
+	}
+	return hex.EncodeToString(id[:]), nil
+}
+
+// checkpointRecord holds the sizes of the files, relative to the sink's
+// directory, that changed since the record before. The record a log starts
+// with has no checkpoint and lists every file.
+type checkpointRecord struct {
+	Checkpoint string           `json:"checkpoint,omitempty"`
+	Files      map[string]int64 `json:"files"`
+}
+
+// checkpointLog records how long a sink's files were at each checkpoint,
+// before the dedup inserts of the checkpoint are committed. After a crash,
+// what was written past the last committed checkpoint is cut off, since
+// those certificates are downloaded and written again.
+type checkpointLog struct {
+	dir     string
+	file    *os.File
+	records int
+	// sizes are the sizes as of the last committed checkpoint, prepared
+	// those recorded since.
+	sizes    map[string]int64
+	prepared map[string]int64
+}
+
+// readCheckpointLog returns the size of every file recorded in dir's log as
+// of the last committed checkpoint; ok is false if there is no log. Only the
+// last record can be uncommitted, since a checkpoint is only recorded once
+// the one before it was committed. A record cut off by a crash was never
+// committed either.
+func readCheckpointLog(dir string, committed committedFunc) (sizes map[string]int64, ok bool, err error) {
+	f, err := os.Open(filepath.Join(dir, kCheckpointLogName))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	var records []checkpointRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<30)
+	var torn error
+	for scanner.Scan() {
+		if torn != nil {
+			return nil, false, torn
+		}
+		var record checkpointRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			torn = fmt.Errorf("%s: %s", f.Name(), err)
+			continue
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, false, err
+	}
+	if n := len(records); n > 0 && records[n-1].Checkpoint != "" && torn == nil {
+		ok, err := committed(records[n-1].Checkpoint)
+		if err != nil {
+			return nil, false, err
+		}
+		if !ok {
+			records = records[:n-1]
+		}
+	}
+	sizes = make(map[string]int64)
+	for _, record := range records {
+		for path, size := range record.Files {
+			sizes[path] = size
+		}
+	}
+	return sizes, true, nil
+}
+
+// newCheckpointLog starts dir's log over with sizes.
+func newCheckpointLog(dir string, sizes map[string]int64) (*checkpointLog, error) {
+	l := &checkpointLog{dir: dir, prepared: make(map[string]int64)}
+	if err := l.rewrite(sizes); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// rewrite replaces the log with a single record of sizes.
+func (l *checkpointLog) rewrite(sizes map[string]int64) error {
+	if err := os.MkdirAll(l.dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(l.dir, kCheckpointLogName)
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(tmp).Encode(checkpointRecord{Files: sizes}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	if err := syncDir(l.dir); err != nil {
+		return err
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+	if l.file, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+		return err
+	}
+	l.sizes = sizes
+	l.records = 1
+	return nil
+}
+
+// prepare durably records the sizes of the files written since the last
+// checkpoint under checkpoint. Nothing is recorded if nothing was written.
+func (l *checkpointLog) prepare(checkpoint string, sizes map[string]int64) error {
+	if len(sizes) == 0 {
+		return nil
+	}
+	line, err := json.Marshal(checkpointRecord{Checkpoint: checkpoint, Files: sizes})
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	for path, size := range sizes {
+		l.prepared[path] = size
+	}
+	l.records++
+	return nil
+}
+
+// commit is called once the last prepared checkpoint was committed.
+func (l *checkpointLog) commit() error {
+	for path, size := range l.prepared {
+		l.sizes[path] = size
+	}
+	l.prepared = make(map[string]int64)
+	if l.records < kCheckpointLogRecords {
+		return nil
+	}
+	return l.rewrite(l.sizes)
+}
+
+// forget drops a file that is complete and will not be written again.
+func (l *checkpointLog) forget(path string) {
+	delete(l.sizes, path)
+	delete(l.prepared, path)
+}
+
+// Close starts the log over with the committed sizes, so that it does not
+// end with a checkpoint only this run's deduper knows of, as in a backfill.
+func (l *checkpointLog) Close() error {
+	err := l.rewrite(l.sizes)
+	if l.file != nil {
+		if closeErr := l.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// syncDir makes renames in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,88 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	kGzip = "gzip"
+	kZstd = "zstd"
+)
+
+// compressor is a compressed stream. Flush makes everything written so far
+// decodable by a reader of the output.
+type compressor interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+// compressionExt is the file extension of compressed output.
+func compressionExt(compression string) (string, error) {
+	switch compression {
+	case "":
+		return "", nil
+	case kGzip:
+		return ".gz", nil
+	case kZstd:
+		return ".zst", nil
+	}
+	return "", fmt.Errorf("unknown compression %q", compression)
+}
+
+// compressionOf is the compression of the file at path, by its extension.
+func compressionOf(path string) string {
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		return kGzip
+	case strings.HasSuffix(path, ".zst"):
+		return kZstd
+	}
+	return ""
+}
+
+func newCompressor(compression string, w io.Writer) (compressor, error) {
+	switch compression {
+	case kGzip:
+		return gzip.NewWriter(w), nil
+	case kZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unknown compression %q", compression)
+}
+
+func newDecompressor(compression string, r io.Reader) (io.ReadCloser, error) {
+	switch compression {
+	case "":
+		return ioutil.NopCloser(r), nil
+	case kGzip:
+		return gzip.NewReader(r)
+	case kZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", compression)
+}
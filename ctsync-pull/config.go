@@ -16,30 +16,154 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"io"
+	"io/ioutil"
 	"log"
-	"os"
+	"strings"
+	"time"
 
 	"github.com/jinzhu/gorm"
 )
 
 type CTLogInfo struct {
 	gorm.Model
-	Name      string `json:"name" gorm:"unique"`
-	BaseURL   string `json:"url" gorm:"unique"`
-	LastIndex int64  `json:"starting_index"`
-	BatchSize int64  `sql:"-" json:"batch_size"`
+	Name             string            `json:"name" gorm:"unique"`
+	BaseURL          string            `json:"url" gorm:"unique"`
+	LastIndex        int64             `json:"starting_index"`
+	BatchSize        int64             `sql:"-" json:"batch_size"`
+	LogID            string            `sql:"-" json:"log_id"`
+	Key              string            `sql:"-" json:"key"`
+	MMD              int64             `sql:"-" json:"mmd"`
+	Operator         string            `sql:"-" json:"operator"`
+	State            *LogState         `sql:"-" json:"state"`
+	TemporalInterval *TemporalInterval `sql:"-" json:"temporal_interval"`
+	Complete         bool              `json:"-"`
+	// API is "rfc6962" (the default) or "static" for logs implementing the
+	// static CT API, which are read from MonitoringPrefix.
+	API              string `sql:"-" json:"api"`
+	MonitoringPrefix string `sql:"-" json:"monitoring_prefix"`
+	// RequestsPerSecond and MaxConcurrentRequests override -log-rps and
+	// -log-concurrency for this log.
+	RequestsPerSecond     float64 `sql:"-" json:"requests_per_second"`
+	MaxConcurrentRequests int     `sql:"-" json:"max_concurrent_requests"`
+	// The last STH whose signature and consistency we verified.
+	STHTreeSize  int64  `json:"-"`
+	STHTimestamp int64  `json:"-"`
+	STHRootHash  string `json:"-"`
+	// The compact Merkle range over entries [0, AuditTreeSize) in -audit mode,
+	// and the leaf hashes downloaded past a gap it is waiting for.
+	AuditTreeSize int64  `json:"-"`
+	AuditHashes   string `json:"-"`
+	AuditPending  string `json:"-"`
+	// The get-entries batch size and parallel requests batchTuner settled
+	// on, within BatchSize and -fetchers.
+	TunedBatchSize int64 `json:"-"`
+	TunedFetchers  int   `json:"-"`
+	// SyncState is one of kLogRunning, kLogBackingOff, kLogFailed or
+	// kLogCompleted; SyncError and RetryAt explain the last two.
+	SyncState string    `json:"-"`
+	SyncError string    `json:"-"`
+	RetryAt   time.Time `json:"-"`
+	// Gaps are the ranges below LastIndex still missing, kept in their own
+	// table.
+	Gaps []LogGap `sql:"-" json:"-"`
+}
+
+func (l *CTLogInfo) monitoringPrefix() string {
+	if l.MonitoringPrefix != "" {
+		return l.MonitoringPrefix
+	}
+	return l.BaseURL
+}
+
+func (l *CTLogInfo) setSyncState(state string, err error, retryAt time.Time) {
+	l.SyncState = state
+	l.SyncError = ""
+	if err != nil {
+		l.SyncError = err.Error()
+	}
+	l.RetryAt = retryAt
+}
+
+// shardExpired reports whether the log is a temporal shard that can no longer
+// grow: every certificate it accepts has expired, and the MMD for the last
+// possible submission has passed.
+func (l *CTLogInfo) shardExpired(now time.Time) bool {
+	if l.TemporalInterval == nil || l.TemporalInterval.EndExclusive.IsZero() {
+		return false
+	}
+	mmd := time.Duration(l.MMD) * time.Second
+	return now.After(l.TemporalInterval.EndExclusive.Add(mmd))
 }
 
 type Configuration []CTLogInfo
 
+// withStates drops every log whose state is not listed in states. Logs that
+// carry no state at all (older line-delimited configs) are always kept.
+func (c Configuration) withStates(states []string) Configuration {
+	wanted := make(map[string]struct{})
+	for _, state := range states {
+		wanted[strings.TrimSpace(strings.ToLower(state))] = struct{}{}
+	}
+	res := Configuration{}
+	for _, l := range c {
+		state := l.State.Name()
+		if _, ok := wanted[state]; state != "" && !ok {
+			log.Printf("%s: skipping log in state %s", l.Name, state)
+			continue
+		}
+		res = append(res, l)
+	}
+	return res
+}
+
+// withName keeps only the log called name, whatever its state.
+func (c Configuration) withName(name string) Configuration {
+	res := Configuration{}
+	for _, l := range c {
+		if l.Name == name {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+// readAndLoadConfiguration accepts either a line-delimited CTLogInfo file or
+// a v3 log list as published by Google and Apple.
 func readAndLoadConfiguration(filepath string, db *gorm.DB) (Configuration, error) {
-	file, err := os.Open(filepath)
+	contents, err := ioutil.ReadFile(filepath)
 	if err != nil {
 		return nil, err
 	}
-	return loadConfiguration(file, db)
+	if isLogList(contents) {
+		return loadLogList(bytes.NewReader(contents), db)
+	}
+	return loadConfiguration(bytes.NewReader(contents), db)
+}
+
+func loadProgressFromDB(db *gorm.DB, parsed *CTLogInfo) {
+	var logConfigFromDB CTLogInfo
+	if db.Where("name = ?", parsed.Name).First(&logConfigFromDB); db.Error != nil {
+		log.Fatalf("error in querying database: %s", db.Error)
+	}
+	parsed.LastIndex = logConfigFromDB.LastIndex
+	parsed.Complete = logConfigFromDB.Complete
+	parsed.STHTreeSize = logConfigFromDB.STHTreeSize
+	parsed.STHTimestamp = logConfigFromDB.STHTimestamp
+	parsed.STHRootHash = logConfigFromDB.STHRootHash
+	parsed.AuditTreeSize = logConfigFromDB.AuditTreeSize
+	parsed.AuditHashes = logConfigFromDB.AuditHashes
+	parsed.AuditPending = logConfigFromDB.AuditPending
+	parsed.TunedBatchSize = logConfigFromDB.TunedBatchSize
+	parsed.TunedFetchers = logConfigFromDB.TunedFetchers
+	parsed.SyncState = logConfigFromDB.SyncState
+	parsed.SyncError = logConfigFromDB.SyncError
+	parsed.RetryAt = logConfigFromDB.RetryAt
+	if err := loadGapsFromDB(db, parsed); err != nil {
+		log.Fatalf("error in querying gaps: %s", err)
+	}
 }
 
 func loadConfiguration(configFile io.Reader, db *gorm.DB) (Configuration, error) {
@@ -51,11 +175,7 @@ func loadConfiguration(configFile io.Reader, db *gorm.DB) (Configuration, error)
 		if err != nil {
 			return nil, err
 		}
-		var logConfigFromDB CTLogInfo
-		if db.Where("name = ?", parsed.Name).First(&logConfigFromDB); db.Error != nil {
-			log.Fatalf("error in querying database: %s", db.Error)
-		}
-		parsed.LastIndex = logConfigFromDB.LastIndex
+		loadProgressFromDB(db, &parsed)
 		res = append(res, parsed)
 	}
 	if err := scanner.Err(); err != nil {
@@ -30,7 +30,7 @@ func newEmptyDatabase() (db *gorm.DB) {
 	}
 	dbPath := path.Join(dir, "db")
 	db, _ = gorm.Open("sqlite3", dbPath)
-	db.AutoMigrate(&CTLogInfo{})
+	db.AutoMigrate(&CTLogInfo{}, &LogGap{})
 	return
 }
 
@@ -42,3 +42,31 @@ func TestLoadConfiguration(t *testing.T) {
 		t.Errorf("%s", err)
 	}
 }
+
+func TestConfigurationWithStates(t *testing.T) {
+	db := newEmptyDatabase()
+	defer db.Close()
+	lines := `{"name":"startcom_log","url":"https://ct.startssl.com/","state":{"retired":{"timestamp":"2018-02-12t11:59:59z"}},"batch_size":10000}
+{"name":"cloudflare_nimbus_2017_log","url":"https://ct.cloudflare.com/logs/nimbus2017/","state":{"readonly":{"final_tree_head":{"sha256_root_hash":"","tree_size":20468368},"timestamp":"2018-01-03t18:35:08z"}},"batch_size":10000}
+{"name":"cloudflare_nimbus_2023_log","url":"https://ct.cloudflare.com/logs/nimbus2023/","state":{"usable":{"timestamp":"2019-06-19t06:31:29z"}},"batch_size":10000}
+{"name":"google_argon2017_log","url":"https://ct.googleapis.com/logs/argon2017/","batch_size":10000}`
+	config, err := loadConfiguration(strings.NewReader(lines), db)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if size, ok := config[1].State.finalTreeSize(); !ok || size != 20468368 {
+		t.Errorf("final tree size not loaded: %d", size)
+	}
+	live := config.withStates([]string{"usable"})
+	if len(live) != 2 || live[0].Name != "cloudflare_nimbus_2023_log" || live[1].Name != "google_argon2017_log" {
+		t.Errorf("unexpected logs for usable: %+v", live)
+	}
+	archival := config.withStates([]string{"usable", "readonly", "retired"})
+	if len(archival) != 4 {
+		t.Errorf("expected 4 logs for archival, got %d", len(archival))
+	}
+	single := config.withName("startcom_log")
+	if len(single) != 1 || single[0].Name != "startcom_log" {
+		t.Errorf("unexpected logs for startcom_log: %+v", single)
+	}
+}
@@ -15,40 +15,73 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
 	log "github.com/sirupsen/logrus"
-	"github.com/teamnsrg/zcrypto/ct/client"
+	"github.com/teamnsrg/zcrypto/ct"
+)
+
+const (
+	kRFC6962API = "rfc6962"
+	kStaticAPI  = "static"
 )
 
+// logBackend is the API-specific half of a log connection: RFC 6962
+// get-sth/get-entries, or the static CT API's checkpoint and tiles.
+type logBackend interface {
+	getSTH() (*ct.SignedTreeHead, error)
+	getConsistencyProof(first, second int64) ([][]byte, error)
+	// scan hands every entry in [start, end) to found, or to unparseable if
+	// it does not parse, reports progress on updater, and returns the index
+	// below which every entry was downloaded.
+	scan(l CTLogInfo, start, end int64, numMatch int, tuner *batchTuner, found func(*ct.LogEntry), unparseable unparseableFunc, updater chan int64) (int64, error)
+}
+
+// unparseableFunc receives the leaf_input of an entry that does not parse,
+// with the reason.
+type unparseableFunc func(index int64, leafInput []byte, err error)
+
 type LogServerConnection struct {
-	logClient  *client.LogClient
+	backend    logBackend
+	sth        *ct.SignedTreeHead
 	treeSize   int64
 	bucketSize int64
 	start      int64
 	end        int64
 }
 
-func merkleTreeSize(logClient *client.LogClient) (uint64, error) {
-	treeHead, err := logClient.GetSTH()
-	if err != nil {
-		return 0, err
+func newLogBackend(l CTLogInfo) logBackend {
+	switch l.API {
+	case "", kRFC6962API:
+		return &rfc6962Backend{baseURL: l.BaseURL}
+	case kStaticAPI:
+		return newStaticBackend(l.monitoringPrefix(), l.Key)
 	}
-	return treeHead.TreeSize, nil
+	log.Warnf("%s: unknown log api %q", l.Name, l.API)
+	return nil
 }
 
-func NewCTLogConnection(uri string, bucketSize int64) *LogServerConnection {
+// NewCTLogConnection fetches and verifies the current STH of l through
+// backend, which is kept across connections.
+func NewCTLogConnection(l CTLogInfo, backend logBackend, bucketSize int64) *LogServerConnection {
 	var c LogServerConnection
 
-	c.logClient = client.New(uri)
-	if c.logClient == nil {
-		log.Warnf("could not create connection to %s", uri)
+	c.backend = backend
+	sth, err := c.backend.getSTH()
+	if err != nil {
+		log.Warnf("could not get tree size from %s STH: %v", l.BaseURL, err)
 		return nil
 	}
-	treeSize, err := merkleTreeSize(c.logClient)
-	if err != nil {
-		log.Warnf("could not get tree size from %s STH: %v", uri, err)
+	if err := verifySTHSignature(l, sth); err != nil {
+		log.Errorf("%s: STH signature verification failed: %v", l.Name, err)
 		return nil
 	}
-	c.treeSize = int64(treeSize)
+	c.sth = sth
+	c.treeSize = int64(sth.TreeSize)
 	if bucketSize >= c.treeSize {
 		c.bucketSize = c.treeSize
 	} else {
@@ -59,8 +92,8 @@ func NewCTLogConnection(uri string, bucketSize int64) *LogServerConnection {
 	return &c
 }
 
-func NewCTLogConnectionWithOffset(uri string, bucketSize int64, start int64) *LogServerConnection {
-	c := NewCTLogConnection(uri, bucketSize)
+func NewCTLogConnectionWithOffset(l CTLogInfo, backend logBackend, bucketSize int64, start int64) *LogServerConnection {
+	c := NewCTLogConnection(l, backend, bucketSize)
 	if c == nil {
 		return nil
 	}
@@ -68,3 +101,65 @@ func NewCTLogConnectionWithOffset(uri string, bucketSize int64, start int64) *Lo
 	c.end = start + c.bucketSize
 	return c
 }
+
+// ctHTTPClient is used for every request to a log. main replaces it with one
+// built from the -http-* flags.
+var ctHTTPClient, _ = newHTTPClient(defaultHTTPOptions, requestLimits)
+
+type rfc6962Backend struct {
+	baseURL string
+}
+
+func (b *rfc6962Backend) getSTH() (*ct.SignedTreeHead, error) {
+	uri := strings.TrimSuffix(b.baseURL, "/") + "/ct/v1/get-sth"
+	resp, err := ctHTTPClient.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &httpStatusError{url: uri, code: resp.StatusCode, status: resp.Status}
+	}
+	var body struct {
+		TreeSize          uint64 `json:"tree_size"`
+		Timestamp         uint64 `json:"timestamp"`
+		SHA256RootHash    []byte `json:"sha256_root_hash"`
+		TreeHeadSignature []byte `json:"tree_head_signature"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decoding get-sth response: %s", err)
+	}
+	if len(body.SHA256RootHash) != len(ct.SHA256Hash{}) {
+		return nil, fmt.Errorf("get-sth returned a %d byte root hash", len(body.SHA256RootHash))
+	}
+	sth := &ct.SignedTreeHead{Version: ct.V1, TreeSize: body.TreeSize, Timestamp: body.Timestamp}
+	copy(sth.SHA256RootHash[:], body.SHA256RootHash)
+	// hash (1) || signature algorithm (1) || signature<0..2^16-1>
+	sig := &tileReader{buf: body.TreeHeadSignature}
+	sth.TreeHeadSignature.HashAlgorithm = ct.HashAlgorithm(sig.uint(1))
+	sth.TreeHeadSignature.SignatureAlgorithm = ct.SignatureAlgorithm(sig.uint(1))
+	sth.TreeHeadSignature.Signature = sig.vector(2)
+	if sig.err != nil || len(sig.buf) != 0 {
+		return nil, errors.New("malformed get-sth tree_head_signature")
+	}
+	return sth, nil
+}
+
+func (b *rfc6962Backend) getConsistencyProof(first, second int64) ([][]byte, error) {
+	uri := fmt.Sprintf("%s/ct/v1/get-sth-consistency?first=%d&second=%d", strings.TrimSuffix(b.baseURL, "/"), first, second)
+	resp, err := ctHTTPClient.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &httpStatusError{url: uri, code: resp.StatusCode, status: resp.Status}
+	}
+	var body struct {
+		Consistency [][]byte `json:"consistency"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.Consistency, nil
+}
@@ -15,80 +15,400 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"math/rand"
 	"sync"
 	"time"
 
 	"github.com/teamnsrg/zcrypto/ct"
-	"github.com/teamnsrg/zcrypto/ct/scanner"
 
 	log "github.com/sirupsen/logrus"
 )
 
 const kMaxFailedScans = 10
 
-func bindFoundBothCertToChannel(out chan *ct.LogEntry) func(*ct.LogEntry, string) {
-	return func(entry *ct.LogEntry, server string) {
-		out <- entry
+// kMaxBatchAttempts is how many scans in a row may fail at the same batch
+// before it is left to repairGap as a gap.
+const kMaxBatchAttempts = 3
+
+// Sync states of a log, as shown by -status.
+const (
+	kLogRunning    = "running"
+	kLogBackingOff = "backing-off"
+	kLogFailed     = "failed"
+	kLogCompleted  = "completed"
+)
+
+const (
+	kBackoffBase = time.Minute
+	kBackoffMax  = time.Hour
+	// kPollInterval is how often a caught-up log is asked for a new STH.
+	kPollInterval = time.Minute
+)
+
+// backoffDelay doubles base for every failure after the first, up to max.
+func backoffDelay(failures int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// jitter picks a random duration in [d/2, d] so that logs failing or polling
+// together spread out.
+func jitter(d time.Duration) time.Duration {
+	if d < 2 {
+		return d
 	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
 }
 
-func pullFromCT(l CTLogInfo, externalCertificateOut chan *ct.LogEntry, updater chan int64, logInfoOut chan CTLogInfo, numMatch int, numFetch int, wg *sync.WaitGroup, running *runState) {
+type pullOptions struct {
+	numMatch int
+	numFetch int
+	audit    bool
+	// start and end, if not negative, restrict the sync to [start, end).
+	start int64
+	end   int64
+	// once stops once the log is caught up instead of polling for more.
+	once bool
+	// operators are the budgets shared by the logs of each operator.
+	operators map[string]*OperatorInfo
+}
+
+func bindFoundBothCertToChannel(logName string, out chan outputItem) func(*ct.LogEntry) {
+	return func(entry *ct.LogEntry) {
+		out <- outputItem{logName: logName, entry: entry}
+	}
+}
+
+// pullFromCT sends the log's entries to out, each batch followed by a
+// checkpoint carrying the progress to save once the batch is durable.
+func pullFromCT(l CTLogInfo, externalCertificateOut chan outputItem, updater chan int64, opts pullOptions, wg *sync.WaitGroup, running *runState) {
 	defer wg.Done()
+	if opts.start >= 0 {
+		l.LastIndex = opts.start
+		l.Complete = false
+	}
+	if opts.start >= 0 || opts.end >= 0 {
+		// Repairs would not be saved in a one-off range download.
+		l.Gaps = nil
+	}
+	if l.Complete {
+		log.Infof("%s: log is complete, skipping", l.Name)
+		return
+	}
+	if l.Key == "" {
+		log.Warnf("%s: no public key configured, STH signatures will not be verified", l.Name)
+	}
+	var auditor *logAuditor
+	if opts.audit {
+		var err error
+		if auditor, err = newLogAuditor(l); err != nil {
+			log.Warnf("%s: not auditing: %s", l.Name, err)
+		}
+	}
+	// Entries that do not parse are still audited, and recorded as missing
+	// once the scan that found them returns. Gap repairs run alongside the
+	// main scan, so each scan is handed the auditor it started with.
+	name := l.Name
+	var unparseableMu sync.Mutex
+	var unparseableGaps []LogGap
+	unparseableEntry := func(auditor *logAuditor) unparseableFunc {
+		return func(index int64, leafInput []byte, err error) {
+			log.Warnf("%s: entry %d does not parse, recording it as missing: %s", name, index, err)
+			if auditor != nil {
+				auditor.addLeafInput(index, leafInput)
+			}
+			unparseableMu.Lock()
+			unparseableGaps = append(unparseableGaps, newUnparseableGap(name, index, err))
+			unparseableMu.Unlock()
+		}
+	}
+	recordUnparseable := func() {
+		unparseableMu.Lock()
+		defer unparseableMu.Unlock()
+		for _, gap := range unparseableGaps {
+			l.Gaps = addGap(l.Gaps, gap)
+		}
+		unparseableGaps = nil
+	}
+	// A failing log backs off on its own; the other logs keep syncing.
+	failures := 0
+	backOff := func(err error) {
+		failures++
+		delay := jitter(backoffDelay(failures, kBackoffBase, kBackoffMax))
+		if failures == kMaxFailedScans {
+			log.Errorf("%s: ALERT: %d consecutive failures, backing off up to %s: %s", l.Name, failures, kBackoffMax, err)
+		} else {
+			log.Warnf("%s: backing off for %s: %s", l.Name, delay, err)
+		}
+		l.setSyncState(kLogBackingOff, err, time.Now().Add(delay))
+		externalCertificateOut <- newCheckpoint(l)
+		running.sleep(delay)
+	}
+	fail := func(err error) {
+		l.setSyncState(kLogFailed, err, time.Time{})
+		externalCertificateOut <- newCheckpoint(l)
+	}
+	sendEntry := bindFoundBothCertToChannel(l.Name, externalCertificateOut)
+	foundEntry := func(auditor *logAuditor) func(*ct.LogEntry) {
+		return func(entry *ct.LogEntry) {
+			if auditor != nil {
+				auditor.add(entry)
+			}
+			sendEntry(entry)
+		}
+	}
+	// checkAudit verifies the audit once it reaches the STH and saves it into
+	// l. It returns false if the audit failed and the sync is halted.
+	checkAudit := func(c *LogServerConnection) bool {
+		if auditor == nil {
+			return true
+		}
+		if auditor.size() == c.treeSize {
+			if err := auditor.verify(c.sth); err != nil {
+				log.Errorf("%s: ALERT: audit failed, halting sync of this log: %s", l.Name, err)
+				fail(fmt.Errorf("audit failed: %s", err))
+				return false
+			}
+			log.Infof("%s: audit verified root of tree size %d", l.Name, c.treeSize)
+		} else if auditBlocked(l, auditor.size()) {
+			// Entries past the gap are kept pending while it is retried.
+			log.Warnf("%s: audit is missing entry %d, not auditing", l.Name, auditor.size())
+			auditor = nil
+			return true
+		}
+		auditor.save(&l)
+		return true
+	}
+	// The backend lives as long as the sync, so that a static log's issuers
+	// are only fetched once.
+	backend := newLogBackend(l)
+	if backend == nil {
+		fail(fmt.Errorf("unknown log api %q", l.API))
+		return
+	}
+	// Gaps are repaired in the background, one at a time and one request at
+	// a time, so that entries a log keeps failing do not hold up the main
+	// scan. The repairs have a backend and tuner of their own.
+	repairBackend := newLogBackend(l)
+	repairTuner := newBatchTuner(l, 1, opts.operators[l.Operator])
+	repairs := make(chan gapRepair, 1)
+	repairing := false
+	startRepair := func() {
+		i := dueGap(l.Gaps, time.Now())
+		if repairing || i < 0 {
+			return
+		}
+		repairing = true
+		go func(l CTLogInfo, gap LogGap, found func(*ct.LogEntry), unparseable unparseableFunc) {
+			repairs <- repairGap(l, gap, repairBackend, opts.numMatch, repairTuner, found, unparseable, updater)
+		}(l, l.Gaps[i], foundEntry(auditor), unparseableEntry(auditor))
+	}
+	// finishRepair records the repair in progress in l.Gaps if it is done,
+	// or, with wait, once it is. It reports whether l changed.
+	finishRepair := func(wait bool) bool {
+		if !repairing {
+			return false
+		}
+		var r gapRepair
+		if wait {
+			r = <-repairs
+		} else {
+			select {
+			case r = <-repairs:
+			default:
+				return false
+			}
+		}
+		repairing = false
+		for i := range l.Gaps {
+			if l.Gaps[i].Start != r.start {
+				continue
+			}
+			if r.repaired {
+				l.Gaps = append(l.Gaps[:i], l.Gaps[i+1:]...)
+			} else {
+				l.Gaps[i] = r.gap
+			}
+			break
+		}
+		l.Gaps = mergeMissingGaps(l.Gaps)
+		recordUnparseable()
+		return true
+	}
+	l.setSyncState(kLogRunning, nil, time.Time{})
+	tuner := newBatchTuner(l, opts.numFetch, opts.operators[l.Operator])
 	failedScanCount := 0
 	for {
 		if !running.checkRunning() {
 			log.Infof("%s: stopping", l.Name)
 			break
 		}
-		if failedScanCount >= kMaxFailedScans {
-			log.Errorf("%s: reached max failed scans (%d)", l.Name, failedScanCount)
-			running.stopRunning()
-			continue
-		}
 		log.Infof("%s: pulling from CT log", l.Name)
-		logConnection := NewCTLogConnectionWithOffset(l.BaseURL, l.BatchSize, l.LastIndex)
+		logConnection := NewCTLogConnectionWithOffset(l, backend, l.BatchSize, l.LastIndex)
 		if logConnection == nil {
-			log.Infof("%s: could not connect to log", l.Name)
-			time.Sleep(time.Second * 60)
+			backOff(errors.New("could not connect to log"))
+			continue
+		}
+		if err := verifyConsistencyWithLastSTH(l, logConnection); err != nil {
+			if _, inconsistent := err.(*inconsistentLogError); inconsistent {
+				log.Errorf("%s: ALERT: log is inconsistent, halting sync of this log: %s", l.Name, err)
+				fail(err)
+				break
+			}
+			if isRateLimited(err) {
+				// The transport holds back the next request as long as the
+				// log asked, so this is not a failure of the log.
+				log.Warnf("%s: could not verify consistency: %s", l.Name, err)
+				continue
+			}
+			backOff(fmt.Errorf("could not verify consistency: %s", err))
 			continue
 		}
-		if l.LastIndex == logConnection.treeSize {
+		if int64(logConnection.sth.Timestamp) > l.STHTimestamp {
+			l.setVerifiedSTH(logConnection.sth)
+			externalCertificateOut <- newCheckpoint(l)
+		}
+		treeSize := logConnection.treeSize
+		if finalTreeSize, ok := l.State.finalTreeSize(); ok && finalTreeSize < treeSize {
+			treeSize = finalTreeSize
+		}
+		if opts.end >= 0 && opts.end < treeSize {
+			treeSize = opts.end
+		}
+		if finishRepair(false) {
+			if !checkAudit(logConnection) {
+				break
+			}
+			externalCertificateOut <- newCheckpoint(l)
+		}
+		startRepair()
+		if l.LastIndex >= treeSize {
+			if opts.end >= 0 {
+				if opts.end > treeSize {
+					log.Warnf("%s: log only has %d entries, stopping before %d", l.Name, treeSize, opts.end)
+				}
+				log.Infof("%s: synchronized up to %d", l.Name, treeSize)
+				break
+			}
+			if (l.State.isFrozen() || l.shardExpired(time.Now())) && !pendingGaps(l.Gaps) {
+				log.Infof("%s: synchronized up to final treeSize, marking complete", l.Name)
+				l.Complete = true
+				l.setSyncState(kLogCompleted, nil, time.Time{})
+				externalCertificateOut <- newCheckpoint(l)
+				break
+			}
 			log.Infof("%s: synchronized up to treeSize", l.Name)
-			time.Sleep(time.Second * 60)
+			if opts.once {
+				break
+			}
+			failures = 0
+			if l.SyncState != kLogRunning {
+				l.setSyncState(kLogRunning, nil, time.Time{})
+				externalCertificateOut <- newCheckpoint(l)
+			}
+			running.sleep(jitter(kPollInterval))
 			continue
 		}
-		count := l.BatchSize * int64(numFetch)
+		count := l.BatchSize * int64(opts.numFetch)
 		maxIndex := l.LastIndex + count
-		if logConnection.treeSize < maxIndex {
-			maxIndex = logConnection.treeSize
-		}
-		scanOpts := scanner.ScannerOptions{
-			Matcher:       &scanner.MatchAll{},
-			PrecertOnly:   false,
-			BatchSize:     l.BatchSize,
-			NumWorkers:    numMatch,
-			ParallelFetch: numFetch,
-			StartIndex:    l.LastIndex,
-			Quiet:         true,
-			Name:          l.Name,
-			MaximumIndex:  maxIndex,
-			ErrorTimeout: 30 * time.Second,
-		}
-		s := scanner.NewScanner(logConnection.logClient, scanOpts, logger)
-		foundCert := bindFoundBothCertToChannel(externalCertificateOut)
-		foundPrecert := bindFoundBothCertToChannel(externalCertificateOut)
-
-		lastIndex, err := s.Scan(foundCert, foundPrecert, updater)
+		if treeSize < maxIndex {
+			maxIndex = treeSize
+		}
+
+		lastIndex, err := logConnection.backend.scan(l, l.LastIndex, maxIndex, opts.numMatch, tuner, foundEntry(auditor), unparseableEntry(auditor), updater)
+		tuner.save(&l)
+		recordUnparseable()
+		if err == nil && lastIndex < maxIndex {
+			err = fmt.Errorf("log returned entries only up to %d", lastIndex)
+		}
 		if err != nil {
-			log.Errorf("%s: scan failed: %s", l.Name, err)
+			log.Errorf("%s: scan failed at %d: %s", l.Name, lastIndex, err)
+			if lastIndex > l.LastIndex {
+				// Keep what was found, and count the failures of the batch the
+				// scan stopped at from scratch.
+				l.LastIndex = lastIndex
+				failedScanCount = 0
+			}
 			failedScanCount++
-			time.Sleep(time.Second * 60)
-			continue
+			if failedScanCount < kMaxBatchAttempts {
+				backOff(err)
+				continue
+			}
+			// Move on, and leave the batch to repairGap.
+			gapEnd := lastIndex + tuner.batch
+			if gapEnd > maxIndex {
+				gapEnd = maxIndex
+			}
+			log.Errorf("%s: skipping entries [%d, %d) after %d failed scans", l.Name, lastIndex, gapEnd, failedScanCount)
+			l.Gaps = addGap(l.Gaps, newLogGap(l, lastIndex, gapEnd, err, time.Now()))
+			lastIndex = gapEnd
+		} else {
+			// A log that fails batch after batch keeps backing off longer.
+			failures = 0
 		}
 		failedScanCount = 0
+		l.setSyncState(kLogRunning, nil, time.Time{})
 		l.LastIndex = lastIndex //CT API doesn't use updater channel once scan is finished
-		logInfoOut <- l
-		log.Infof("%s: finished scan through %d", l.Name, maxIndex)
-		time.Sleep(time.Second * 5)
+		if !checkAudit(logConnection) {
+			break
+		}
+		externalCertificateOut <- newCheckpoint(l)
+		log.Infof("%s: finished scan through %d", l.Name, lastIndex)
+		running.sleep(time.Second * 5)
+	}
+	// The repair's entries must be sent before pullFromCT returns.
+	if finishRepair(true) {
+		if auditor != nil {
+			auditor.save(&l)
+		}
+		externalCertificateOut <- newCheckpoint(l)
+	}
+}
+
+// gapRepair is the outcome of repairGap for the gap starting at start: either
+// repaired, or gap as it is to be retried.
+type gapRepair struct {
+	start    int64
+	gap      LogGap
+	repaired bool
+}
+
+// repairGap downloads gap again.
+func repairGap(l CTLogInfo, gap LogGap, backend logBackend, numMatch int, tuner *batchTuner, found func(*ct.LogEntry), unparseable unparseableFunc, updater chan int64) gapRepair {
+	r := gapRepair{start: gap.Start}
+	log.Infof("%s: retrying entries [%d, %d)", l.Name, gap.Start, gap.End)
+	index := gap.Start
+	var err error
+	if c := NewCTLogConnection(l, backend, l.BatchSize); c == nil {
+		err = errors.New("could not connect to log")
+	} else {
+		index, err = backend.scan(l, gap.Start, gap.End, numMatch, tuner, found, unparseable, updater)
+		if err == nil && index >= gap.End {
+			log.Infof("%s: repaired entries [%d, %d)", l.Name, gap.Start, gap.End)
+			r.repaired = true
+			return r
+		}
+		if err == nil {
+			err = fmt.Errorf("log returned entries only up to %d", index)
+		}
+	}
+	if index > gap.Start {
+		gap.Start = index
+	}
+	gap.failed(err, time.Now())
+	if gap.Missing {
+		log.Errorf("%s: giving up on entries [%d, %d) after %d attempts: %s", l.Name, gap.Start, gap.End, gap.Attempts, err)
+	} else {
+		log.Warnf("%s: entries [%d, %d) still missing, retrying at %s: %s", l.Name, gap.Start, gap.End, gap.NextAttempt.Format(time.RFC3339), err)
 	}
+	r.gap = gap
+	return r
 }
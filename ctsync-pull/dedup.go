@@ -0,0 +1,575 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// Deduper remembers which certificates have already been written out, keyed
+// by the hex SHA-256 of the leaf certificate or precertificate.
+type Deduper interface {
+	// InsertIfNew marks the records seen and returns the indexes of those
+	// that were not seen before. It checks and marks the whole batch in one
+	// step, so two writers never both see a certificate as new.
+	InsertIfNew(records []*certHashes) ([]int, error)
+	// Commit makes the inserts since the last Commit permanent, and records
+	// that checkpoint was reached if there were any. It is called once the
+	// certificates they stand for are durable in the output, so a crash in
+	// between forgets them rather than losing them.
+	Commit(checkpoint string) error
+	// Committed reports whether the Commit of checkpoint happened, which
+	// tells the sinks after a crash what output to keep.
+	Committed(checkpoint string) (bool, error)
+	// Close discards inserts that were not committed.
+	Close() error
+}
+
+// pendingTx is the transaction the inserts since the last Commit run in.
+// Commit records its checkpoint in the ctsync_checkpoints table, which holds
+// only the last one of each instance.
+type pendingTx struct {
+	db *sql.DB
+	tx *sql.Tx
+	// previous are the checkpoints the next Commit removes.
+	previous []string
+}
+
+func (p *pendingTx) begin() (*sql.Tx, error) {
+	if p.tx == nil {
+		tx, err := p.db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		p.tx = tx
+	}
+	return p.tx, nil
+}
+
+func (p *pendingTx) Commit(checkpoint string) error {
+	if p.tx == nil {
+		return nil
+	}
+	if _, err := p.tx.Exec("INSERT INTO ctsync_checkpoints (checkpoint) VALUES ($1)", checkpoint); err != nil {
+		p.rollback()
+		return err
+	}
+	for _, previous := range p.previous {
+		if _, err := p.tx.Exec("DELETE FROM ctsync_checkpoints WHERE checkpoint = $1", previous); err != nil {
+			p.rollback()
+			return err
+		}
+	}
+	err := p.tx.Commit()
+	p.tx = nil
+	if err == nil {
+		p.previous = []string{checkpoint}
+	}
+	return err
+}
+
+// Committed also lets the next Commit remove a checkpoint left by a crash.
+func (p *pendingTx) Committed(checkpoint string) (bool, error) {
+	var count int
+	err := p.db.QueryRow("SELECT COUNT(*) FROM ctsync_checkpoints WHERE checkpoint = $1", checkpoint).Scan(&count)
+	if err != nil || count == 0 {
+		return false, err
+	}
+	p.previous = append(p.previous, checkpoint)
+	return true, nil
+}
+
+func (p *pendingTx) rollback() {
+	if p.tx != nil {
+		p.tx.Rollback()
+		p.tx = nil
+	}
+}
+
+// seenIterator is implemented by dedup backends that can list every hash
+// they have seen, which is needed to rebuild a bloom filter.
+type seenIterator interface {
+	ForEachSeen(fn func(sha256 []byte)) error
+}
+
+// hintedInserter is implemented by dedup backends that can skip the lookup
+// for records a bloom filter has ruled out.
+type hintedInserter interface {
+	// InsertIfNewHinted is InsertIfNew, told which records may have been
+	// seen before. The others were never inserted.
+	InsertIfNewHinted(records []*certHashes, maybeSeen []bool) ([]int, error)
+}
+
+// bloomStamper is implemented by dedup backends that insert records ruled
+// out by the filter blindly, and so must never be paired with a filter that
+// misses some of their keys. A saved filter is only used if the backend
+// still holds the stamp it was saved with: any run since then clears it.
+type bloomStamper interface {
+	bloomStamp() (bloomStamp, bool)
+	// setBloomStamp discards the inserts that were not committed; it is
+	// only called on Close.
+	setBloomStamp(stamp bloomStamp) error
+}
+
+type dedupOptions struct {
+	backend string
+	// postgres opens the Postgres connection, only if it is needed.
+	postgres func() (*sql.DB, error)
+	// sqlite is the progress database.
+	sqlite *sql.DB
+	// path is the bolt file.
+	path string
+	// bloom puts a bloomDeduper in front of the backend.
+	bloom         bool
+	bloomPath     string
+	bloomCapacity uint64
+	bloomFPRate   float64
+}
+
+func newDeduper(opts dedupOptions) (Deduper, error) {
+	var d Deduper
+	var err error
+	switch opts.backend {
+	case "postgres":
+		var db *sql.DB
+		if db, err = opts.postgres(); err == nil {
+			d, err = newPostgresDeduper(db)
+		}
+	case "sqlite":
+		d, err = newSQLiteDeduper(opts.sqlite)
+	case "bolt":
+		d, err = newBoltDeduper(opts.path)
+	case "memory":
+		d = newMemoryDeduper()
+	default:
+		err = fmt.Errorf("unknown dedup backend %q", opts.backend)
+	}
+	if err != nil || !opts.bloom {
+		return d, err
+	}
+	return newBloomDeduper(d, opts.bloomPath, opts.bloomCapacity, opts.bloomFPRate)
+}
+
+// postgresDeduper uses the downloaded_certs table created by db/*.sql, which
+// can be shared by several ctsync-pull instances. An instance inserting a
+// certificate another one holds in an uncommitted transaction waits for that
+// transaction to finish. Since a transaction spans every batch until the next
+// checkpoint, two instances can deadlock; Postgres then aborts one of them,
+// which inserts its pending records again and retries.
+type postgresDeduper struct {
+	pendingTx
+	// pending are the records inserted since the last Commit.
+	pending []*certHashes
+	// aborted is set when the transaction holding pending was rolled back.
+	aborted bool
+}
+
+// newPostgresDeduper creates ctsync_checkpoints if it is missing. The check
+// comes first, since creating a table needs privileges the ctdownloader user
+// may not have once db/*.sql created it.
+func newPostgresDeduper(db *sql.DB) (*postgresDeduper, error) {
+	var exists bool
+	if err := db.QueryRow("SELECT to_regclass('ctsync_checkpoints') IS NOT NULL").Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		if _, err := db.Exec(kCheckpointsTable); err != nil {
+			return nil, fmt.Errorf("creating ctsync_checkpoints (see db/create_tables.sql): %s", err)
+		}
+	}
+	return &postgresDeduper{pendingTx: pendingTx{db: db}}, nil
+}
+
+// kCheckpointsTable holds the checkpoints Commit recorded.
+const kCheckpointsTable = `CREATE TABLE IF NOT EXISTS ctsync_checkpoints (
+		checkpoint TEXT NOT NULL PRIMARY KEY
+	)`
+
+// kPostgresAttempts is how often a batch is tried when Postgres aborts the
+// transaction to break a deadlock.
+const kPostgresAttempts = 5
+
+// isPostgresConflict reports whether Postgres aborted the transaction because
+// of a deadlock or serialization failure, which a retry can resolve.
+func isPostgresConflict(err error) bool {
+	if pqErr, ok := err.(*pq.Error); ok {
+		return pqErr.Code == "40P01" || pqErr.Code == "40001"
+	}
+	return false
+}
+
+// insert runs fn, which inserts records, in the pending transaction. If the
+// transaction is aborted by a conflict with another instance, the records
+// inserted since the last Commit are inserted again in a new transaction
+// before fn is retried. The certificates another instance inserted in the
+// meantime may end up in both instances' output.
+func (d *postgresDeduper) insert(records []*certHashes, fn func(tx *sql.Tx) ([]int, error)) ([]int, error) {
+	for attempt := 1; ; attempt++ {
+		tx, err := d.begin()
+		if err != nil {
+			return nil, err
+		}
+		if d.aborted {
+			err = d.replay(tx)
+		}
+		var res []int
+		if err == nil {
+			res, err = fn(tx)
+		}
+		if err == nil {
+			for _, idx := range res {
+				d.pending = append(d.pending, records[idx])
+			}
+			return res, nil
+		}
+		d.rollback()
+		if !isPostgresConflict(err) || attempt == kPostgresAttempts {
+			d.pending = nil
+			d.aborted = false
+			return nil, err
+		}
+		d.aborted = true
+		delay := jitter(time.Duration(attempt) * 100 * time.Millisecond)
+		log.Warnf("dedup transaction aborted, retrying in %s: %s", delay, err)
+		time.Sleep(delay)
+	}
+}
+
+func (d *postgresDeduper) replay(tx *sql.Tx) error {
+	inserted, err := insertIntoPostgres(tx, d.pending)
+	if err != nil {
+		return err
+	}
+	if lost := len(d.pending) - len(inserted); lost > 0 {
+		log.Warnf("%d certificates already written out were inserted by another instance while retrying", lost)
+	}
+	d.aborted = false
+	return nil
+}
+
+func (d *postgresDeduper) Commit(checkpoint string) error {
+	d.pending = nil
+	d.aborted = false
+	return d.pendingTx.Commit(checkpoint)
+}
+
+func decodeHashes(hashes []string) (pq.ByteaArray, error) {
+	res := make(pq.ByteaArray, len(hashes))
+	for i, sha256 := range hashes {
+		raw, err := hex.DecodeString(sha256)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = raw
+	}
+	return res, nil
+}
+
+func decodeRecords(records []*certHashes) (pq.ByteaArray, pq.ByteaArray, error) {
+	sha256s := make([]string, len(records))
+	tbsNoCTs := make([]string, len(records))
+	for i, record := range records {
+		sha256s[i] = record.SHA256
+		tbsNoCTs[i] = record.TBS_NO_CT_SHA256
+	}
+	sha256Array, err := decodeHashes(sha256s)
+	if err != nil {
+		return nil, nil, err
+	}
+	tbsNoCTArray, err := decodeHashes(tbsNoCTs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sha256Array, tbsNoCTArray, nil
+}
+
+func scanHashes(rows *sql.Rows) (map[string]struct{}, error) {
+	defer rows.Close()
+	res := make(map[string]struct{})
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			return nil, err
+		}
+		res[hex.EncodeToString(raw)] = struct{}{}
+	}
+	return res, rows.Err()
+}
+
+// kPostgresInsert relies on the unique index from db/create_indexes.sql to
+// detect certificates another batch or instance already inserted.
+const kPostgresInsert = `INSERT INTO downloaded_certs (sha256, tbs_no_ct_sha256)
+	SELECT * FROM unnest($1::bytea[], $2::bytea[])
+	ON CONFLICT DO NOTHING`
+
+// kPostgresLookup finds which of a batch of hashes are already known.
+const kPostgresLookup = `SELECT sha256 FROM downloaded_certs WHERE sha256 = ANY($1::bytea[])`
+
+// InsertIfNew inserts the records in a single statement.
+func (d *postgresDeduper) InsertIfNew(records []*certHashes) ([]int, error) {
+	return d.insert(records, func(tx *sql.Tx) ([]int, error) {
+		return insertIntoPostgres(tx, records)
+	})
+}
+
+// InsertIfNewHinted looks up only the records that may have been seen, and
+// inserts the rest of the batch without a lookup. The insert still skips
+// conflicts, since other instances write to the table too.
+func (d *postgresDeduper) InsertIfNewHinted(records []*certHashes, maybeSeen []bool) ([]int, error) {
+	candidates := make([]string, 0)
+	for idx, record := range records {
+		if maybeSeen[idx] {
+			candidates = append(candidates, record.SHA256)
+		}
+	}
+	keys, err := decodeHashes(candidates)
+	if err != nil {
+		return nil, err
+	}
+	return d.insert(records, func(tx *sql.Tx) ([]int, error) {
+		seen := make(map[string]struct{})
+		if len(keys) > 0 {
+			rows, err := tx.Query(kPostgresLookup, keys)
+			if err != nil {
+				return nil, err
+			}
+			if seen, err = scanHashes(rows); err != nil {
+				return nil, err
+			}
+		}
+		indexes := make([]int, 0, len(records))
+		unseen := make([]*certHashes, 0, len(records))
+		for idx, record := range records {
+			if _, ok := seen[record.SHA256]; !ok {
+				indexes = append(indexes, idx)
+				unseen = append(unseen, record)
+			}
+		}
+		inserted, err := insertIntoPostgres(tx, unseen)
+		if err != nil {
+			return nil, err
+		}
+		res := make([]int, len(inserted))
+		for i, idx := range inserted {
+			res[i] = indexes[idx]
+		}
+		return res, nil
+	})
+}
+
+// insertIntoPostgres returns the indexes of the records it inserted. Rows are
+// inserted in hash order, so that concurrent batches lock them in the same
+// order.
+func insertIntoPostgres(tx *sql.Tx, records []*certHashes) ([]int, error) {
+	if len(records) == 0 {
+		return []int{}, nil
+	}
+	sorted := make([]*certHashes, len(records))
+	copy(sorted, records)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].SHA256 < sorted[j].SHA256 })
+	sha256s, tbsNoCTs, err := decodeRecords(sorted)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(kPostgresInsert+" RETURNING sha256", sha256s, tbsNoCTs)
+	if err != nil {
+		return nil, err
+	}
+	inserted, err := scanHashes(rows)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]int, 0, len(inserted))
+	for idx, record := range records {
+		if _, ok := inserted[record.SHA256]; ok {
+			res = append(res, idx)
+			// Only the first of several identical records is new.
+			delete(inserted, record.SHA256)
+		}
+	}
+	return res, nil
+}
+
+func (d *postgresDeduper) ForEachSeen(fn func(sha256 []byte)) error {
+	return forEachSeenInTable(d.db, fn)
+}
+
+func (d *postgresDeduper) Close() error {
+	d.rollback()
+	return d.db.Close()
+}
+
+func forEachSeenInTable(db *sql.DB, fn func(sha256 []byte)) error {
+	rows, err := db.Query("SELECT sha256 FROM downloaded_certs")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sha256 []byte
+		if err := rows.Scan(&sha256); err != nil {
+			return err
+		}
+		fn(sha256)
+	}
+	return rows.Err()
+}
+
+// sqliteDeduper keeps the seen certificates in the same SQLite file that
+// stores sync progress, for deployments without a Postgres server.
+type sqliteDeduper struct {
+	pendingTx
+}
+
+func newSQLiteDeduper(db *sql.DB) (*sqliteDeduper, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS downloaded_certs (
+		sha256 BLOB NOT NULL PRIMARY KEY,
+		tbs_no_ct_sha256 BLOB NOT NULL
+	)`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS downloaded_certs_tbs_no_ct_sha256 ON downloaded_certs (tbs_no_ct_sha256)")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(kCheckpointsTable); err != nil {
+		return nil, err
+	}
+	return &sqliteDeduper{pendingTx{db: db}}, nil
+}
+
+func (d *sqliteDeduper) InsertIfNew(records []*certHashes) ([]int, error) {
+	sha256s, tbsNoCTs, err := decodeRecords(records)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := d.begin()
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := tx.Prepare("INSERT OR IGNORE INTO downloaded_certs (sha256, tbs_no_ct_sha256) VALUES (?, ?)")
+	if err != nil {
+		d.rollback()
+		return nil, err
+	}
+	defer stmt.Close()
+	res := make([]int, 0)
+	for idx := range records {
+		result, err := stmt.Exec(sha256s[idx], tbsNoCTs[idx])
+		if err != nil {
+			d.rollback()
+			return nil, err
+		}
+		if inserted, err := result.RowsAffected(); err != nil {
+			d.rollback()
+			return nil, err
+		} else if inserted > 0 {
+			res = append(res, idx)
+		}
+	}
+	return res, nil
+}
+
+func (d *sqliteDeduper) ForEachSeen(fn func(sha256 []byte)) error {
+	return forEachSeenInTable(d.db, fn)
+}
+
+// Close leaves the database open; it belongs to the progress tracking.
+func (d *sqliteDeduper) Close() error {
+	d.rollback()
+	return nil
+}
+
+// memoryDeduper forgets everything on restart. It is meant for tests and
+// one-off runs.
+type memoryDeduper struct {
+	seen map[string]struct{}
+}
+
+func newMemoryDeduper() *memoryDeduper {
+	return &memoryDeduper{seen: make(map[string]struct{})}
+}
+
+func (d *memoryDeduper) InsertIfNew(records []*certHashes) ([]int, error) {
+	res := make([]int, 0)
+	for idx, record := range records {
+		if _, ok := d.seen[record.SHA256]; !ok {
+			d.seen[record.SHA256] = struct{}{}
+			res = append(res, idx)
+		}
+	}
+	return res, nil
+}
+
+func (d *memoryDeduper) Commit(checkpoint string) error {
+	return nil
+}
+
+// Committed is false: after a restart, everything is written again.
+func (d *memoryDeduper) Committed(checkpoint string) (bool, error) {
+	return false, nil
+}
+
+func (d *memoryDeduper) ForEachSeen(fn func(sha256 []byte)) error {
+	for sha256 := range d.seen {
+		raw, err := hex.DecodeString(sha256)
+		if err != nil {
+			return err
+		}
+		fn(raw)
+	}
+	return nil
+}
+
+func (d *memoryDeduper) Close() error {
+	return nil
+}
+
+// rangeDeduper deduplicates a one-off range download within the run only,
+// so that a backfill neither skips the certificates backend has seen nor
+// marks the ones it writes. backend only tells which checkpoints of earlier
+// runs were committed, to recover the output they left.
+type rangeDeduper struct {
+	seen    *memoryDeduper
+	backend Deduper
+}
+
+func newRangeDeduper(backend Deduper) *rangeDeduper {
+	return &rangeDeduper{seen: newMemoryDeduper(), backend: backend}
+}
+
+func (d *rangeDeduper) InsertIfNew(records []*certHashes) ([]int, error) {
+	return d.seen.InsertIfNew(records)
+}
+
+func (d *rangeDeduper) Commit(checkpoint string) error {
+	return nil
+}
+
+func (d *rangeDeduper) Committed(checkpoint string) (bool, error) {
+	return d.backend.Committed(checkpoint)
+}
+
+func (d *rangeDeduper) Close() error {
+	return d.backend.Close()
+}
@@ -0,0 +1,184 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// kBloomStatsInterval is how many batches pass between false positive rate
+// reports.
+const kBloomStatsInterval = 100
+
+// bloomDeduper keeps a bloom filter of every seen hash next to the backend,
+// so that the backend only looks up the records the filter may contain. The
+// rest are inserted without a lookup, in the same atomic step as the others.
+// It also reports how often another writer inserted a certificate behind the
+// filter's back.
+//
+// The filter is saved only on a clean Close and removed as soon as it is
+// loaded; after a crash, when the sizing flags change, or when a backend
+// that trusts the filter blindly was used without it since, it is rebuilt
+// from the backend.
+type bloomDeduper struct {
+	backend Deduper
+	filter  *bloomFilter
+	path    string
+
+	batches        int
+	lookups        int
+	maybeSeen      int
+	falsePositives int
+	misses         int
+}
+
+func newBloomDeduper(backend Deduper, path string, capacity uint64, fpRate float64) (*bloomDeduper, error) {
+	d := &bloomDeduper{backend: backend, path: path}
+	filter, stamp, err := loadBloomFilter(path, capacity, fpRate)
+	if err == nil {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+		if stamper, ok := backend.(bloomStamper); ok {
+			if current, ok := stamper.bloomStamp(); !ok || current != stamp {
+				err = errors.New("the dedup backend was written to without it since it was saved")
+			}
+		}
+	}
+	if err == nil {
+		log.Infof("loaded bloom filter from %s", path)
+		d.filter = filter
+		return d, nil
+	}
+	if !os.IsNotExist(err) {
+		log.Warnf("not using bloom filter %s: %s", path, err)
+	}
+
+	iterator, ok := backend.(seenIterator)
+	if !ok {
+		return nil, fmt.Errorf("cannot rebuild bloom filter: dedup backend cannot list seen hashes")
+	}
+	if d.filter, err = newBloomFilter(capacity, fpRate); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	count := 0
+	err = iterator.ForEachSeen(func(sha256 []byte) {
+		d.filter.add(sha256)
+		count++
+	})
+	if err != nil {
+		return nil, fmt.Errorf("rebuilding bloom filter: %s", err)
+	}
+	log.Infof("rebuilt bloom filter from %d seen certificates in %s", count, time.Since(start))
+	if uint64(count) > capacity {
+		log.Warnf("bloom filter holds %d certificates but is sized for %d; raise -bloom-capacity", count, capacity)
+	}
+	return d, nil
+}
+
+// InsertIfNew tells the backend which records the filter rules out. Keys are
+// added to the filter as they are checked, so a record repeated within the
+// batch may have been seen. Backends that cannot use the hint get a plain
+// InsertIfNew.
+func (d *bloomDeduper) InsertIfNew(records []*certHashes) ([]int, error) {
+	maybeSeen := make([]bool, len(records))
+	for idx, record := range records {
+		key, err := hex.DecodeString(record.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		maybeSeen[idx] = d.filter.mayContain(key)
+		if maybeSeen[idx] {
+			d.maybeSeen++
+		}
+		d.filter.add(key)
+	}
+	var inserted []int
+	var err error
+	if hinted, ok := d.backend.(hintedInserter); ok {
+		inserted, err = hinted.InsertIfNewHinted(records, maybeSeen)
+	} else {
+		inserted, err = d.backend.InsertIfNew(records)
+	}
+	if err != nil {
+		return nil, err
+	}
+	isNew := make([]bool, len(records))
+	for _, idx := range inserted {
+		isNew[idx] = true
+		if maybeSeen[idx] {
+			d.falsePositives++
+		}
+	}
+	for idx := range records {
+		if !maybeSeen[idx] && !isNew[idx] {
+			d.misses++
+		}
+	}
+
+	d.batches++
+	d.lookups += len(records)
+	if d.batches%kBloomStatsInterval == 0 {
+		d.logStats()
+	}
+	return inserted, nil
+}
+
+func (d *bloomDeduper) Commit(checkpoint string) error {
+	return d.backend.Commit(checkpoint)
+}
+
+func (d *bloomDeduper) Committed(checkpoint string) (bool, error) {
+	return d.backend.Committed(checkpoint)
+}
+
+func (d *bloomDeduper) logStats() {
+	if d.lookups == 0 {
+		return
+	}
+	var fpRate float64
+	if unseen := d.lookups - d.maybeSeen + d.falsePositives; unseen > 0 {
+		fpRate = float64(d.falsePositives) / float64(unseen)
+	}
+	log.Infof("bloom filter: %d lookups, %d ruled out, %d false positives (rate %.4f), %d seen by another writer",
+		d.lookups, d.lookups-d.maybeSeen, d.falsePositives, fpRate, d.misses)
+}
+
+func (d *bloomDeduper) Close() error {
+	d.logStats()
+	var stamp bloomStamp
+	if _, err := rand.Read(stamp[:]); err != nil {
+		log.Errorf("not saving bloom filter: %s", err)
+		return d.backend.Close()
+	}
+	if stamper, ok := d.backend.(bloomStamper); ok {
+		if err := stamper.setBloomStamp(stamp); err != nil {
+			log.Errorf("not saving bloom filter: %s", err)
+			return d.backend.Close()
+		}
+	}
+	if err := d.filter.save(d.path, stamp); err != nil {
+		log.Errorf("could not save bloom filter to %s: %s", d.path, err)
+	}
+	return d.backend.Close()
+}
@@ -0,0 +1,180 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltSHA256Bucket  = []byte("sha256")
+	boltTBSNoCTBucket = []byte("tbs_no_ct_sha256")
+	boltMetaBucket    = []byte("meta")
+	boltBloomStampKey = []byte("bloom_stamp")
+	boltCheckpointKey = []byte("checkpoint")
+)
+
+// boltDeduper keeps the seen certificates in a bbolt file on local disk, for
+// a single host syncing every log. The sha256 bucket maps SHA256 to
+// TBS_NO_CT_SHA256; the tbs_no_ct_sha256 bucket indexes the reverse
+// direction with TBS_NO_CT_SHA256 || SHA256 keys. The meta bucket holds the
+// stamp of the bloom filter saved on the last clean shutdown, and the last
+// checkpoint committed.
+type boltDeduper struct {
+	db *bolt.DB
+	// tx holds the inserts since the last Commit.
+	tx *bolt.Tx
+	// stamp is the bloom stamp found on open, which is cleared right away.
+	stamp    bloomStamp
+	hasStamp bool
+}
+
+func newBoltDeduper(path string) (*boltDeduper, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	d := &boltDeduper{db: db}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltSHA256Bucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(boltTBSNoCTBucket); err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		if stamp := meta.Get(boltBloomStampKey); len(stamp) == len(d.stamp) {
+			copy(d.stamp[:], stamp)
+			d.hasStamp = true
+		}
+		return meta.Delete(boltBloomStampKey)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (d *boltDeduper) InsertIfNew(records []*certHashes) ([]int, error) {
+	return d.InsertIfNewHinted(records, nil)
+}
+
+// InsertIfNewHinted puts the records that were never seen without looking
+// them up first. A nil maybeSeen looks up every record.
+func (d *boltDeduper) InsertIfNewHinted(records []*certHashes, maybeSeen []bool) ([]int, error) {
+	if d.tx == nil {
+		tx, err := d.db.Begin(true)
+		if err != nil {
+			return nil, err
+		}
+		d.tx = tx
+	}
+	res, err := insertIfNewInBolt(d.tx, records, maybeSeen)
+	if err != nil {
+		d.tx.Rollback()
+		d.tx = nil
+		return nil, err
+	}
+	return res, nil
+}
+
+func insertIfNewInBolt(tx *bolt.Tx, records []*certHashes, maybeSeen []bool) ([]int, error) {
+	shaBucket := tx.Bucket(boltSHA256Bucket)
+	tbsBucket := tx.Bucket(boltTBSNoCTBucket)
+	res := make([]int, 0)
+	for idx, record := range records {
+		sha256, err := hex.DecodeString(record.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		if (maybeSeen == nil || maybeSeen[idx]) && shaBucket.Get(sha256) != nil {
+			continue
+		}
+		tbsNoCT, err := hex.DecodeString(record.TBS_NO_CT_SHA256)
+		if err != nil {
+			return nil, err
+		}
+		if err := shaBucket.Put(sha256, tbsNoCT); err != nil {
+			return nil, err
+		}
+		if err := tbsBucket.Put(append(tbsNoCT, sha256...), []byte{}); err != nil {
+			return nil, err
+		}
+		res = append(res, idx)
+	}
+	return res, nil
+}
+
+func (d *boltDeduper) Commit(checkpoint string) error {
+	if d.tx == nil {
+		return nil
+	}
+	if err := d.tx.Bucket(boltMetaBucket).Put(boltCheckpointKey, []byte(checkpoint)); err != nil {
+		d.tx.Rollback()
+		d.tx = nil
+		return err
+	}
+	err := d.tx.Commit()
+	d.tx = nil
+	return err
+}
+
+func (d *boltDeduper) Committed(checkpoint string) (bool, error) {
+	var res bool
+	err := d.db.View(func(tx *bolt.Tx) error {
+		res = string(tx.Bucket(boltMetaBucket).Get(boltCheckpointKey)) == checkpoint
+		return nil
+	})
+	return res, err
+}
+
+func (d *boltDeduper) bloomStamp() (bloomStamp, bool) {
+	return d.stamp, d.hasStamp
+}
+
+func (d *boltDeduper) setBloomStamp(stamp bloomStamp) error {
+	if d.tx != nil {
+		d.tx.Rollback()
+		d.tx = nil
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMetaBucket).Put(boltBloomStampKey, stamp[:])
+	})
+}
+
+func (d *boltDeduper) ForEachSeen(fn func(sha256 []byte)) error {
+	return d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSHA256Bucket).ForEach(func(k, v []byte) error {
+			fn(k)
+			return nil
+		})
+	})
+}
+
+func (d *boltDeduper) Close() error {
+	if d.tx != nil {
+		d.tx.Rollback()
+		d.tx = nil
+	}
+	return d.db.Close()
+}
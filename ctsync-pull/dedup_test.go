@@ -0,0 +1,280 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testHash(i int) string {
+	return fmt.Sprintf("%064x", i)
+}
+
+func testHashBytes(i int) []byte {
+	raw, _ := hex.DecodeString(testHash(i))
+	return raw
+}
+
+func testRecords(from, to int) []*certHashes {
+	records := []*certHashes{}
+	for i := from; i < to; i++ {
+		records = append(records, &certHashes{SHA256: testHash(i), TBS_NO_CT_SHA256: testHash(i + 1<<20)})
+	}
+	return records
+}
+
+func testDeduper(t *testing.T, d Deduper) {
+	inserted, err := d.InsertIfNew(testRecords(0, 600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inserted) != 600 {
+		t.Fatalf("expected all 600 records inserted, got %d", len(inserted))
+	}
+
+	inserted, err = d.InsertIfNew(testRecords(598, 603))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(inserted, []int{2, 3, 4}) {
+		t.Errorf("expected [2 3 4] inserted, got %v", inserted)
+	}
+
+	// Only the first of two identical records in a batch is new.
+	records := append(testRecords(700, 701), testRecords(700, 701)...)
+	inserted, err = d.InsertIfNew(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(inserted, []int{0}) {
+		t.Errorf("expected [0] inserted, got %v", inserted)
+	}
+
+	inserted, err = d.InsertIfNew(testRecords(0, 1200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inserted) != 1200-604 {
+		t.Errorf("expected %d inserted, got %d", 1200-604, len(inserted))
+	}
+	if err := d.Commit("test"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryDeduper(t *testing.T) {
+	testDeduper(t, newMemoryDeduper())
+}
+
+func TestRangeDeduper(t *testing.T) {
+	db := newEmptyDatabase()
+	defer db.Close()
+	backend, err := newSQLiteDeduper(db.DB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCommitted(t, backend)
+	d := newRangeDeduper(backend)
+	testDeduper(t, d)
+	// The backfill found the backend's certificates new, and left it alone.
+	if inserted, err := backend.InsertIfNew(testRecords(0, 1)); err != nil || len(inserted) != 1 {
+		t.Errorf("backfill marked certificates in the backend: %v, %v", inserted, err)
+	}
+	if ok, err := d.Committed("second"); err != nil || !ok {
+		t.Errorf("Committed(%q) = %v, %v", "second", ok, err)
+	}
+}
+
+func TestSQLiteDeduper(t *testing.T) {
+	db := newEmptyDatabase()
+	defer db.Close()
+	d, err := newSQLiteDeduper(db.DB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDeduper(t, d)
+	testCommitted(t, d)
+}
+
+// testCommitted checks that a deduper remembers the last checkpoint it
+// committed inserts for.
+func testCommitted(t *testing.T, d Deduper) {
+	if _, err := d.InsertIfNew(testRecords(2000, 2001)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Commit("second"); err != nil {
+		t.Fatal(err)
+	}
+	for checkpoint, want := range map[string]bool{"second": true, "other": false} {
+		if ok, err := d.Committed(checkpoint); err != nil || ok != want {
+			t.Errorf("Committed(%q) = %v, %v", checkpoint, ok, err)
+		}
+	}
+}
+
+func TestBoltDeduper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctsync-dedup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := newBoltDeduper(filepath.Join(dir, "dedup.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	testDeduper(t, d)
+	testCommitted(t, d)
+}
+
+func TestBoltDeduperUncommitted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctsync-dedup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dedup.bolt")
+	d, err := newBoltDeduper(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.InsertIfNew(testRecords(0, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Commit("test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.InsertIfNew(testRecords(2, 4)); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	// Only the committed records survive.
+	d, err = newBoltDeduper(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	inserted, err := d.InsertIfNew(testRecords(0, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(inserted, []int{2, 3}) {
+		t.Errorf("expected [2 3] inserted, got %v", inserted)
+	}
+}
+
+func TestBloomDeduper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctsync-dedup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bloomPath := filepath.Join(dir, "dedup.bloom")
+	backend := newMemoryDeduper()
+	d, err := newBloomDeduper(backend, bloomPath, 1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDeduper(t, d)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The saved filter is loaded, and removed until the next clean Close.
+	d, err = newBloomDeduper(backend, bloomPath, 1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(bloomPath); !os.IsNotExist(err) {
+		t.Error("bloom filter file kept while in use")
+	}
+	if !d.filter.mayContain(testHashBytes(1199)) {
+		t.Error("seen certificate missing from reloaded filter")
+	}
+
+	// Without a saved filter, it is rebuilt from the backend.
+	d, err = newBloomDeduper(backend, bloomPath, 1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.filter.mayContain(testHashBytes(1199)) {
+		t.Error("seen certificate missing from rebuilt filter")
+	}
+	inserted, err := d.InsertIfNew(testRecords(1199, 1201))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(inserted, []int{1}) {
+		t.Errorf("expected [1] inserted after rebuilding, got %v", inserted)
+	}
+}
+
+func TestBloomDeduperBolt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctsync-dedup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	boltPath := filepath.Join(dir, "dedup.bolt")
+	bloomPath := filepath.Join(dir, "dedup.bloom")
+	open := func() *bloomDeduper {
+		backend, err := newBoltDeduper(boltPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := newBloomDeduper(backend, bloomPath, 10000, 0.01)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	d := open()
+	testDeduper(t, d)
+	if d.lookups-d.maybeSeen == 0 {
+		t.Error("filter ruled nothing out")
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A run without the filter invalidates the saved one.
+	backend, err := newBoltDeduper(boltPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.InsertIfNew(testRecords(5000, 5001)); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Commit("test"); err != nil {
+		t.Fatal(err)
+	}
+	backend.Close()
+	d = open()
+	defer d.Close()
+	inserted, err := d.InsertIfNew(testRecords(5000, 5002))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(inserted, []int{1}) {
+		t.Errorf("expected [1] inserted with a stale filter file, got %v", inserted)
+	}
+}
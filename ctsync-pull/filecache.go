@@ -0,0 +1,126 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"container/list"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// kPartitionsPerYear is how many files a csv or jsonl output writes for a
+	// year: one per three hex digits of the certificate hash.
+	kPartitionsPerYear = 4096
+	// kOpenYears is how many years are written at once, as logs cross into
+	// a new year.
+	kOpenYears = 2
+	// kReservedFiles are the descriptors left for sockets and the databases.
+	kReservedFiles = 256
+)
+
+// openFileKey identifies an output file: the sink's files it belongs to, and
+// its partition.
+type openFileKey struct {
+	owner interface{}
+	key   string
+}
+
+type openFile struct {
+	id    openFileKey
+	evict func() error
+}
+
+// fileLRU bounds how many output files the sinks keep open at once. When a
+// file has to be opened past max, the least recently used one is evicted:
+// closed, to be reopened on demand. It is only used from the goroutine
+// writing the output.
+type fileLRU struct {
+	max int
+	// order is most recently used first.
+	order *list.List
+	files map[openFileKey]*list.Element
+}
+
+// openFiles is shared by every sink.
+var openFiles = newFileLRU(kOpenYears * kPartitionsPerYear)
+
+// defaultMaxOpenFiles is enough to keep every partition of the outputs open,
+// as far as the open file limit allows, so that files are not closed and
+// reopened as certificates spread over them.
+func defaultMaxOpenFiles(configs []SinkConfig) int {
+	// An open Parquet file also holds its journal open.
+	wanted, descriptors := 0, 0
+	for _, cfg := range configs {
+		if cfg.Type == kParquetSink {
+			prefixLength := cfg.PrefixLength
+			if prefixLength <= 0 {
+				prefixLength = kDefaultParquetPrefixLength
+			}
+			wanted += kOpenYears << (4 * uint(prefixLength))
+			descriptors += 2 * kOpenYears << (4 * uint(prefixLength))
+		} else {
+			wanted += kOpenYears * kPartitionsPerYear
+			descriptors += kOpenYears * kPartitionsPerYear
+		}
+	}
+	limit, ok := openFileLimit()
+	if !ok || descriptors == 0 || limit >= uint64(descriptors+kReservedFiles) {
+		return wanted
+	}
+	max := (int(limit) - kReservedFiles) * wanted / descriptors
+	if max < 1 {
+		max = 1
+	}
+	log.Warnf("the open file limit of %d leaves room for %d of the %d output files; raise ulimit -n to keep them all open", limit, max, wanted)
+	return max
+}
+
+func newFileLRU(max int) *fileLRU {
+	return &fileLRU{max: max, order: list.New(), files: make(map[openFileKey]*list.Element)}
+}
+
+// touch marks id as just used. If it is not open yet, it is added with evict
+// as the way to close it, evicting other files first to stay within max. The
+// caller opens the file after touch succeeds, and calls remove if it cannot.
+func (c *fileLRU) touch(id openFileKey, evict func() error) error {
+	if elem, ok := c.files[id]; ok {
+		c.order.MoveToFront(elem)
+		return nil
+	}
+	for c.order.Len() >= c.max && c.order.Len() > 0 {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		file := oldest.Value.(*openFile)
+		delete(c.files, file.id)
+		if err := file.evict(); err != nil {
+			return err
+		}
+	}
+	c.files[id] = c.order.PushFront(&openFile{id: id, evict: evict})
+	return nil
+}
+
+// remove forgets id, once its owner closed it.
+func (c *fileLRU) remove(id openFileKey) {
+	if elem, ok := c.files[id]; ok {
+		c.order.Remove(elem)
+		delete(c.files, id)
+	}
+}
+
+func (c *fileLRU) len() int {
+	return c.order.Len()
+}
@@ -0,0 +1,119 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileLRU(t *testing.T) {
+	c := newFileLRU(2)
+	var evicted []string
+	touch := func(key string) {
+		if err := c.touch(openFileKey{key: key}, func() error {
+			evicted = append(evicted, key)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	touch("a")
+	touch("b")
+	touch("a")
+	touch("c")
+	touch("d")
+	c.remove(openFileKey{key: "d"})
+	touch("e")
+	if fmt.Sprint(evicted) != "[b a]" || c.len() != 2 {
+		t.Errorf("evicted %v, %d open", evicted, c.len())
+	}
+}
+
+func TestPartitionedFilesEviction(t *testing.T) {
+	defer func(saved *fileLRU) { openFiles = saved }(openFiles)
+	openFiles = newFileLRU(1)
+	dir, err := ioutil.TempDir("", "ctsync-filecache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	appended, err := newPartitionedFiles(filepath.Join(dir, "append"), ".csv", partitionOptions{}, notCommitted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segmented, err := newPartitionedFiles(filepath.Join(dir, "segments"), ".csv", partitionOptions{compression: kGzip}, notCommitted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		for _, p := range []*partitionedFiles{appended, segmented} {
+			for _, prefix := range []string{"abc", "def"} {
+				w, err := p.writer("2024", prefix)
+				if err != nil {
+					t.Fatal(err)
+				}
+				fmt.Fprintf(w, "line %d\n", i)
+				open := 0
+				for _, files := range []*partitionedFiles{appended, segmented} {
+					for _, file := range files.files {
+						if !file.suspended {
+							open++
+						}
+					}
+				}
+				if openFiles.len() != 1 || open != 1 {
+					t.Fatalf("%d files open, %d tracked", open, openFiles.len())
+				}
+			}
+		}
+		// Suspended files are synced and recorded at a checkpoint.
+		if err := segmented.Flush("test"); err != nil {
+			t.Fatal(err)
+		}
+		if size := segmented.checkpoints.prepared[filepath.Join("2024", "abc-000001.csv.gz.open")]; size == 0 {
+			t.Fatalf("suspended segment not recorded")
+		}
+		if err := segmented.Committed(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := appended.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := segmented.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if openFiles.len() != 0 {
+		t.Errorf("%d files still tracked after Close", openFiles.len())
+	}
+
+	// Evicted files are reopened and appended to, segments included.
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "append", "2024", "abc.csv"))
+	if err != nil || string(contents) != "line 0\nline 1\nline 2\nline 3\n" {
+		t.Errorf("appended file holds %q, %v", contents, err)
+	}
+	segments, _ := filepath.Glob(filepath.Join(dir, "segments", "2024", "abc-*"))
+	if len(segments) != 1 {
+		t.Fatalf("segments %v", segments)
+	}
+	if contents := readSegment(t, segments[0]); contents != "line 0\nline 1\nline 2\nline 3\n" {
+		t.Errorf("segment holds %q", contents)
+	}
+}
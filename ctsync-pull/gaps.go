@@ -0,0 +1,205 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// kMaxGapAttempts is how often a gap is retried before its entries are
+	// reported as permanently missing.
+	kMaxGapAttempts = 10
+	kGapBackoffBase = time.Minute
+	kGapBackoffMax  = 6 * time.Hour
+)
+
+// LogGap is a range of entries [Start, End) that the main sync skipped after
+// the log failed to serve it. It is retried with exponential backoff until
+// it is downloaded or Missing.
+type LogGap struct {
+	gorm.Model
+	LogName     string `gorm:"index"`
+	Start       int64
+	End         int64
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+	// Missing means the gap is no longer retried.
+	Missing bool
+}
+
+func newLogGap(l CTLogInfo, start, end int64, err error, now time.Time) LogGap {
+	gap := LogGap{LogName: l.Name, Start: start, End: end}
+	gap.failed(err, now)
+	return gap
+}
+
+func (g *LogGap) failed(err error, now time.Time) {
+	g.Attempts++
+	g.LastError = err.Error()
+	if g.Attempts >= kMaxGapAttempts {
+		g.Missing = true
+		return
+	}
+	g.NextAttempt = now.Add(backoffDelay(g.Attempts, kGapBackoffBase, kGapBackoffMax))
+}
+
+// newUnparseableGap records an entry that was downloaded but does not parse.
+// Downloading it again would not help, so it is missing right away.
+func newUnparseableGap(logName string, index int64, err error) LogGap {
+	return LogGap{
+		LogName:   logName,
+		Start:     index,
+		End:       index + 1,
+		Attempts:  1,
+		LastError: fmt.Sprintf("entry does not parse: %s", err),
+		Missing:   true,
+	}
+}
+
+// addGap inserts gap into gaps, which are sorted by Start. Adjacent missing
+// gaps are merged, so that a run of entries that do not parse is one row.
+func addGap(gaps []LogGap, gap LogGap) []LogGap {
+	i := sort.Search(len(gaps), func(i int) bool { return gaps[i].Start >= gap.Start })
+	gaps = append(gaps, LogGap{})
+	copy(gaps[i+1:], gaps[i:])
+	gaps[i] = gap
+	return mergeMissingGaps(gaps)
+}
+
+func mergeMissingGaps(gaps []LogGap) []LogGap {
+	merged := gaps[:0]
+	for _, gap := range gaps {
+		if n := len(merged); n > 0 && gap.Missing && merged[n-1].Missing && merged[n-1].End == gap.Start {
+			merged[n-1].End = gap.End
+			continue
+		}
+		merged = append(merged, gap)
+	}
+	return merged
+}
+
+// missingEntries counts the entries in gaps that are no longer retried.
+func missingEntries(gaps []LogGap) int64 {
+	var n int64
+	for _, gap := range gaps {
+		if gap.Missing {
+			n += gap.End - gap.Start
+		}
+	}
+	return n
+}
+
+// dueGap returns the index of the first gap to retry now, or -1.
+func dueGap(gaps []LogGap, now time.Time) int {
+	for i, gap := range gaps {
+		if !gap.Missing && !now.Before(gap.NextAttempt) {
+			return i
+		}
+	}
+	return -1
+}
+
+// pendingGaps reports whether any gap may still be downloaded.
+func pendingGaps(gaps []LogGap) bool {
+	for _, gap := range gaps {
+		if !gap.Missing {
+			return true
+		}
+	}
+	return false
+}
+
+func loadGapsFromDB(db *gorm.DB, l *CTLogInfo) error {
+	return db.Where("log_name = ?", l.Name).Order("start").Find(&l.Gaps).Error
+}
+
+// saveGapsToDB makes the stored gaps of l match l.Gaps. Gaps are matched by
+// Start, and only the rows that changed are written.
+func saveGapsToDB(db *gorm.DB, l CTLogInfo) error {
+	var stored []LogGap
+	if err := db.Where("log_name = ?", l.Name).Find(&stored).Error; err != nil {
+		return err
+	}
+	byStart := make(map[int64]LogGap, len(stored))
+	var stale []LogGap
+	for _, gap := range stored {
+		if _, ok := byStart[gap.Start]; ok {
+			stale = append(stale, gap)
+			continue
+		}
+		byStart[gap.Start] = gap
+	}
+	var changed []LogGap
+	for _, gap := range l.Gaps {
+		old, ok := byStart[gap.Start]
+		delete(byStart, gap.Start)
+		if ok && sameGap(old, gap) {
+			continue
+		}
+		gap.Model = old.Model
+		gap.LogName = l.Name
+		changed = append(changed, gap)
+	}
+	for _, gap := range byStart {
+		stale = append(stale, gap)
+	}
+	if len(changed) == 0 && len(stale) == 0 {
+		return nil
+	}
+	tx := db.Begin()
+	for _, gap := range stale {
+		if err := tx.Unscoped().Delete(&gap).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, gap := range changed {
+		if err := tx.Save(&gap).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+func sameGap(a, b LogGap) bool {
+	return a.Start == b.Start && a.End == b.End && a.Attempts == b.Attempts &&
+		a.NextAttempt.Equal(b.NextAttempt) && a.LastError == b.LastError && a.Missing == b.Missing
+}
+
+// printGaps writes every gap of the configured logs, including the entries
+// that are permanently missing.
+func printGaps(out io.Writer, configuration Configuration) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTART\tEND\tATTEMPTS\tSTATUS\tLAST ERROR")
+	for _, l := range configuration {
+		for _, gap := range l.Gaps {
+			status := fmt.Sprintf("retry at %s", gap.NextAttempt.Format(time.RFC3339))
+			if gap.Missing {
+				status = "missing"
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%s\n", l.Name, gap.Start, gap.End, gap.Attempts, status, gap.LastError)
+		}
+	}
+	w.Flush()
+}
@@ -0,0 +1,115 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLogGapBackoff(t *testing.T) {
+	now := time.Now()
+	gap := newLogGap(CTLogInfo{Name: "test"}, 100, 200, errors.New("boom"), now)
+	if gap.Attempts != 1 || !gap.NextAttempt.Equal(now.Add(kGapBackoffBase)) {
+		t.Errorf("unexpected first attempt: %+v", gap)
+	}
+	if i := dueGap([]LogGap{gap}, now); i != -1 {
+		t.Errorf("gap due before its backoff")
+	}
+	if i := dueGap([]LogGap{gap}, gap.NextAttempt); i != 0 {
+		t.Errorf("gap not due after its backoff")
+	}
+	gap.failed(errors.New("boom"), now)
+	if !gap.NextAttempt.Equal(now.Add(2 * kGapBackoffBase)) {
+		t.Errorf("backoff did not double: %s", gap.NextAttempt.Sub(now))
+	}
+	for gap.Attempts < kMaxGapAttempts {
+		if gap.NextAttempt.Sub(now) > kGapBackoffMax {
+			t.Errorf("backoff %s exceeds maximum", gap.NextAttempt.Sub(now))
+		}
+		gap.failed(errors.New("boom"), now)
+	}
+	if !gap.Missing || pendingGaps([]LogGap{gap}) {
+		t.Error("gap not missing after the last attempt")
+	}
+}
+
+func TestUnparseableGap(t *testing.T) {
+	gaps := []LogGap{
+		newLogGap(CTLogInfo{Name: "test"}, 100, 200, errors.New("boom"), time.Now()),
+		newUnparseableGap("test", 300, errors.New("bad certificate")),
+	}
+	if dueGap(gaps[1:], time.Now()) != -1 || pendingGaps(gaps[1:]) {
+		t.Error("unparseable entry is retried")
+	}
+	if n := missingEntries(gaps); n != 1 {
+		t.Errorf("%d entries missing, expected 1", n)
+	}
+}
+
+func TestAddGapMergesMissing(t *testing.T) {
+	var gaps []LogGap
+	for _, index := range []int64{12, 10, 11, 20} {
+		gaps = addGap(gaps, newUnparseableGap("test", index, errors.New("bad certificate")))
+	}
+	gaps = addGap(gaps, newLogGap(CTLogInfo{Name: "test"}, 13, 20, errors.New("boom"), time.Now()))
+	if len(gaps) != 3 || gaps[0].Start != 10 || gaps[0].End != 13 || gaps[1].Start != 13 || gaps[2].Start != 20 {
+		t.Errorf("unexpected gaps: %+v", gaps)
+	}
+}
+
+func TestSaveAndLoadGaps(t *testing.T) {
+	db := newEmptyDatabase()
+	defer db.Close()
+	now := time.Now()
+	l := CTLogInfo{Name: "test"}
+	l.Gaps = []LogGap{
+		newLogGap(l, 300, 400, errors.New("later"), now),
+		newLogGap(l, 100, 200, errors.New("earlier"), now),
+	}
+	if err := saveGapsToDB(db, l); err != nil {
+		t.Fatal(err)
+	}
+	loaded := CTLogInfo{Name: "test"}
+	if err := loadGapsFromDB(db, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	l.Gaps = l.Gaps[1:]
+	if err := saveGapsToDB(db, l); err != nil {
+		t.Fatal(err)
+	}
+	unchanged := loaded.Gaps[0]
+	if err := loadGapsFromDB(db, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Gaps) != 1 || loaded.Gaps[0].Start != 100 || loaded.Gaps[0].LastError != "earlier" {
+		t.Errorf("unexpected gaps: %+v", loaded.Gaps)
+	}
+	if loaded.Gaps[0].ID != unchanged.ID || !loaded.Gaps[0].UpdatedAt.Equal(unchanged.UpdatedAt) {
+		t.Error("unchanged gap was written again")
+	}
+
+	l.Gaps[0].failed(errors.New("again"), now)
+	if err := saveGapsToDB(db, l); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadGapsFromDB(db, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Gaps) != 1 || loaded.Gaps[0].ID != unchanged.ID || loaded.Gaps[0].Attempts != 2 {
+		t.Errorf("unexpected gaps after update: %+v", loaded.Gaps)
+	}
+}
@@ -0,0 +1,226 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teamnsrg/zcrypto/ct"
+)
+
+// kMaxRateLimited is how many 429 or 503 responses in a row fail a scan.
+const kMaxRateLimited = 10
+
+// httpStatusError is an unexpected HTTP status from a log.
+type httpStatusError struct {
+	url    string
+	code   int
+	status string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("GET %s: %s", e.url, e.status)
+}
+
+func isRateLimited(err error) bool {
+	statusErr, ok := err.(*httpStatusError)
+	return ok && (statusErr.code == http.StatusTooManyRequests || statusErr.code == http.StatusServiceUnavailable)
+}
+
+type rawEntry struct {
+	LeafInput []byte `json:"leaf_input"`
+	ExtraData []byte `json:"extra_data"`
+}
+
+// getEntries asks for entries [start, end). The log may return fewer.
+func (b *rfc6962Backend) getEntries(start, end int64) ([]rawEntry, error) {
+	uri := fmt.Sprintf("%s/ct/v1/get-entries?start=%d&end=%d", strings.TrimSuffix(b.baseURL, "/"), start, end-1)
+	resp, err := ctHTTPClient.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &httpStatusError{url: uri, code: resp.StatusCode, status: resp.Status}
+	}
+	var body struct {
+		Entries []rawEntry `json:"entries"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decoding get-entries response: %s", err)
+	}
+	if int64(len(body.Entries)) > end-start {
+		return nil, fmt.Errorf("log returned %d entries for %d requested", len(body.Entries), end-start)
+	}
+	return body.Entries, nil
+}
+
+// parseRawEntry decodes an RFC 6962 MerkleTreeLeaf and its extra_data.
+func parseRawEntry(index int64, raw rawEntry) (*ct.LogEntry, error) {
+	r := &tileReader{buf: raw.LeafInput}
+	if version := r.uint(1); version != uint64(ct.V1) {
+		return nil, fmt.Errorf("unknown leaf version %d", version)
+	}
+	if leafType := r.uint(1); leafType != uint64(ct.TimestampedEntryLeafType) {
+		return nil, fmt.Errorf("unknown leaf type %d", leafType)
+	}
+	var timestamped ct.TimestampedEntry
+	timestamped.Timestamp = r.uint(8)
+	timestamped.EntryType = ct.LogEntryType(r.uint(2))
+	extra := &tileReader{buf: raw.ExtraData}
+	var precert ct.ASN1Cert
+	switch timestamped.EntryType {
+	case ct.X509LogEntryType:
+		timestamped.X509Entry = r.vector(3)
+	case ct.PrecertLogEntryType:
+		copy(timestamped.PrecertEntry.IssuerKeyHash[:], r.next(32))
+		timestamped.PrecertEntry.TBSCertificate = r.vector(3)
+		precert = extra.vector(3)
+	default:
+		return nil, fmt.Errorf("unknown entry type %d", timestamped.EntryType)
+	}
+	timestamped.Extensions = r.vector(2)
+	if r.err != nil {
+		return nil, r.err
+	}
+	chainBytes := &tileReader{buf: extra.vector(3)}
+	if extra.err != nil {
+		return nil, extra.err
+	}
+	var chain []ct.ASN1Cert
+	for len(chainBytes.buf) > 0 {
+		chain = append(chain, chainBytes.vector(3))
+	}
+	if chainBytes.err != nil {
+		return nil, chainBytes.err
+	}
+	return buildLogEntry(index, timestamped, precert, chain)
+}
+
+type getEntriesResult struct {
+	start   int64
+	entries []rawEntry
+	latency time.Duration
+	err     error
+}
+
+// scan fetches [start, end) in rounds of parallel get-entries requests sized
+// by tuner, and parses the responses with numMatch workers.
+func (b *rfc6962Backend) scan(l CTLogInfo, start, end int64, numMatch int, tuner *batchTuner, found func(*ct.LogEntry), unparseable unparseableFunc, updater chan int64) (int64, error) {
+	index := start
+	rateLimited := 0
+	for index < end {
+		batch := tuner.batch
+		results := b.fetchRound(index, end, batch, tuner.fetchers, tuner.pool)
+		var err error
+		var entries []rawEntry
+		first := index
+		for _, result := range results {
+			if result.err != nil {
+				err = result.err
+				break
+			}
+			requested := batch
+			if end-result.start < requested {
+				requested = end - result.start
+			}
+			tuner.observe(requested, int64(len(result.entries)), result.latency)
+			if len(result.entries) == 0 {
+				err = fmt.Errorf("log returned no entries from %d", result.start)
+				break
+			}
+			entries = append(entries, result.entries...)
+			// Later responses start after a hole; fetch them again.
+			if int64(len(result.entries)) < requested {
+				break
+			}
+		}
+		parseEntries(first, entries, numMatch, found, unparseable)
+		index = first + int64(len(entries))
+		if len(entries) > 0 {
+			updater <- index
+		}
+
+		// The transport holds back the next request as long as the log asked.
+		if isRateLimited(err) {
+			tuner.rateLimited()
+			if rateLimited++; rateLimited < kMaxRateLimited {
+				continue
+			}
+		}
+		if err != nil {
+			return index, err
+		}
+		rateLimited = 0
+	}
+	return index, nil
+}
+
+// fetchRound requests up to fetchers consecutive batches starting at index in
+// parallel, each holding a slot of pool. The results are in order.
+func (b *rfc6962Backend) fetchRound(index, end, batch int64, fetchers int, pool fetcherPool) []getEntriesResult {
+	var results []getEntriesResult
+	for i := 0; i < fetchers && index < end; i++ {
+		results = append(results, getEntriesResult{start: index})
+		index += batch
+	}
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(result *getEntriesResult) {
+			defer wg.Done()
+			requestEnd := result.start + batch
+			if requestEnd > end {
+				requestEnd = end
+			}
+			pool.acquire()
+			defer pool.release()
+			began := time.Now()
+			result.entries, result.err = b.getEntries(result.start, requestEnd)
+			result.latency = time.Since(began)
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+// parseEntries hands the entries starting at index first to found, parsed by
+// numMatch workers. Entries that cannot be parsed go to unparseable.
+func parseEntries(first int64, entries []rawEntry, numMatch int, found func(*ct.LogEntry), unparseable unparseableFunc) {
+	if numMatch < 1 {
+		numMatch = 1
+	}
+	var wg sync.WaitGroup
+	for worker := 0; worker < numMatch; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := worker; i < len(entries); i += numMatch {
+				entry, err := parseRawEntry(first+int64(i), entries[i])
+				if err != nil {
+					unparseable(first+int64(i), entries[i].LeafInput, err)
+					continue
+				}
+				found(entry)
+			}
+		}(worker)
+	}
+	wg.Wait()
+}
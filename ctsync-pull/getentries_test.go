@@ -0,0 +1,139 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/teamnsrg/zcrypto/ct"
+)
+
+// cappedLog serves get-entries for a log of size entries, at most limit per
+// response.
+func cappedLog(t *testing.T, size, limit int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start, _ := strconv.ParseInt(r.URL.Query().Get("start"), 10, 64)
+		end, _ := strconv.ParseInt(r.URL.Query().Get("end"), 10, 64)
+		if end >= size {
+			end = size - 1
+		}
+		if end-start+1 > limit {
+			end = start + limit - 1
+		}
+		var body struct {
+			Entries []rawEntry `json:"entries"`
+		}
+		for i := start; i <= end; i++ {
+			body.Entries = append(body.Entries, rawEntry{LeafInput: []byte{byte(i)}})
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+}
+
+func TestRFC6962ScanShortResponses(t *testing.T) {
+	server := cappedLog(t, 100, 3)
+	defer server.Close()
+	b := &rfc6962Backend{baseURL: server.URL}
+	l := CTLogInfo{Name: "test", BatchSize: 10}
+	tuner := newBatchTuner(l, 2, nil)
+	updater := make(chan int64, 100)
+	var mu sync.Mutex
+	seen := 0
+	found := func(*ct.LogEntry) {
+		mu.Lock()
+		seen++
+		mu.Unlock()
+	}
+	var unparseable []int64
+	skipped := func(index int64, leafInput []byte, err error) {
+		mu.Lock()
+		if len(leafInput) != 1 || int64(leafInput[0]) != index {
+			t.Errorf("entry %d has leaf_input %x", index, leafInput)
+		}
+		unparseable = append(unparseable, index)
+		mu.Unlock()
+	}
+	index, err := b.scan(l, 5, 25, 2, tuner, found, skipped, updater)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != 25 {
+		t.Errorf("scan stopped at %d, expected 25", index)
+	}
+	if tuner.batch != 3 {
+		t.Errorf("expected batch size 3, got %d", tuner.batch)
+	}
+	// The fake leaves do not parse.
+	if seen != 0 || len(unparseable) != 20 {
+		t.Errorf("%d unparsable entries were found, %d reported", seen, len(unparseable))
+	}
+	tuner.save(&l)
+	if l.TunedBatchSize != 3 || l.TunedFetchers != 2 {
+		t.Errorf("unexpected tuned values %d, %d", l.TunedBatchSize, l.TunedFetchers)
+	}
+}
+
+func TestBatchTuner(t *testing.T) {
+	l := CTLogInfo{Name: "test", BatchSize: 1000, TunedBatchSize: 32, TunedFetchers: 8}
+	tuner := newBatchTuner(l, 4, nil)
+	if tuner.batch != 32 || tuner.fetchers != 4 {
+		t.Fatalf("unexpected initial values %d, %d", tuner.batch, tuner.fetchers)
+	}
+	tuner.rateLimited()
+	if tuner.fetchers != 2 {
+		t.Errorf("expected 2 fetchers after a 429, got %d", tuner.fetchers)
+	}
+	tuner.observe(32, 32, 20*time.Second)
+	if tuner.fetchers != 1 {
+		t.Errorf("expected 1 fetcher after a slow response, got %d", tuner.fetchers)
+	}
+	for i := 0; i < 4*kTuneInterval; i++ {
+		tuner.observe(tuner.batch, tuner.batch, time.Second)
+	}
+	// First more fetchers, then a larger batch.
+	if tuner.fetchers != 4 {
+		t.Errorf("expected fetchers to recover to 4, got %d", tuner.fetchers)
+	}
+	if tuner.batch != 64 {
+		t.Errorf("expected batch size probe 64, got %d", tuner.batch)
+	}
+	tuner.observe(64, 40, time.Second)
+	if tuner.batch != 40 {
+		t.Errorf("expected batch size 40 after a short response, got %d", tuner.batch)
+	}
+	// A response cut short at a page boundary does not lower the cap.
+	tuner.observe(40, 7, time.Second)
+	if tuner.batch != 40 {
+		t.Errorf("expected batch size 40 after a partial page, got %d", tuner.batch)
+	}
+}
+
+func TestConsistencyProofRateLimited(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	b := &rfc6962Backend{baseURL: server.URL}
+	if _, err := b.getConsistencyProof(1, 2); !isRateLimited(err) {
+		t.Errorf("429 not reported as rate limited: %v", err)
+	}
+}
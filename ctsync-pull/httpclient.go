@@ -0,0 +1,121 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	kDefaultUserAgent   = "ctsync-pull"
+	kDefaultHTTPTimeout = 30 * time.Second
+	kDefaultIdleConns   = 10
+)
+
+// httpOptions configure the client used for every request to a log.
+type httpOptions struct {
+	// proxy is the outbound proxy URL. Empty uses HTTPS_PROXY and friends
+	// from the environment.
+	proxy string
+	// caBundle is a PEM file of CA certificates trusted in addition to the
+	// system roots, e.g. those of an intercepting proxy.
+	caBundle string
+	// timeout bounds one request, not the time it waits for rate limits.
+	timeout time.Duration
+	// maxIdleConns is how many keep-alive connections are kept per host.
+	maxIdleConns int
+	disableHTTP2 bool
+	userAgent    string
+	// contact is appended to the User-Agent so operators can reach us.
+	contact string
+}
+
+var defaultHTTPOptions = httpOptions{
+	timeout:      kDefaultHTTPTimeout,
+	maxIdleConns: kDefaultIdleConns,
+	userAgent:    kDefaultUserAgent,
+}
+
+func (o httpOptions) userAgentHeader() string {
+	userAgent := o.userAgent
+	if userAgent == "" {
+		userAgent = kDefaultUserAgent
+	}
+	if o.contact != "" {
+		userAgent = fmt.Sprintf("%s (+%s)", userAgent, o.contact)
+	}
+	return userAgent
+}
+
+// newHTTPClient builds a client whose requests wait for the limits of the log
+// they go to.
+func newHTTPClient(opts httpOptions, limits *rateLimits) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if opts.proxy != "" {
+		proxyURL, err := url.Parse(opts.proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %s", opts.proxy, err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+	tlsConfig := &tls.Config{}
+	if opts.caBundle != "" {
+		pem, err := ioutil.ReadFile(opts.caBundle)
+		if err != nil {
+			return nil, err
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + opts.caBundle)
+		}
+		tlsConfig.RootCAs = roots
+	}
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   10 * time.Second,
+		MaxIdleConnsPerHost:   opts.maxIdleConns,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     !opts.disableHTTP2,
+	}
+	if opts.disableHTTP2 {
+		// A non-nil, empty map turns off HTTP/2 over TLS.
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return &http.Client{
+		Transport: &limitedTransport{
+			base:      transport,
+			limits:    limits,
+			timeout:   opts.timeout,
+			userAgent: opts.userAgentHeader(),
+		},
+	}, nil
+}
@@ -0,0 +1,95 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRFC6962GetSTH(t *testing.T) {
+	var userAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+		// A zero root hash and an ECDSA/SHA-256 signature "abc".
+		fmt.Fprint(w, `{"tree_size":42,"timestamp":1500000000000,`+
+			`"sha256_root_hash":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",`+
+			`"tree_head_signature":"BAMAA2FiYw=="}`)
+	}))
+	defer server.Close()
+
+	client, err := newHTTPClient(httpOptions{userAgent: "test", contact: "ct@example.com"}, newRateLimits())
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := ctHTTPClient
+	ctHTTPClient = client
+	defer func() { ctHTTPClient = saved }()
+
+	sth, err := (&rfc6962Backend{baseURL: server.URL + "/"}).getSTH()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sth.TreeSize != 42 || sth.Timestamp != 1500000000000 || string(sth.TreeHeadSignature.Signature) != "abc" {
+		t.Errorf("unexpected STH %+v", sth)
+	}
+	if sth.TreeHeadSignature.HashAlgorithm != 4 || sth.TreeHeadSignature.SignatureAlgorithm != 3 {
+		t.Errorf("unexpected signature algorithms %+v", sth.TreeHeadSignature)
+	}
+	if userAgent != "test (+ct@example.com)" {
+		t.Errorf("unexpected User-Agent %q", userAgent)
+	}
+}
+
+func TestHTTPClientCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	untrusting, err := newHTTPClient(defaultHTTPOptions, newRateLimits())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := untrusting.Get(server.URL); err == nil {
+		t.Fatal("trusted the test server without its CA")
+	}
+
+	dir, err := ioutil.TempDir("", "ctsync-httpclient-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bundle := filepath.Join(dir, "ca.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}
+	if err := ioutil.WriteFile(bundle, pem.EncodeToMemory(block), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := defaultHTTPOptions
+	opts.caBundle = bundle
+	trusting, err := newHTTPClient(opts, newRateLimits())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := trusting.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
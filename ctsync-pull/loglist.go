@@ -0,0 +1,197 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// kDefaultBatchSize is the batch size given to logs read from a log list,
+// matching what the generate*LogsConfig.sh scripts used to emit.
+const kDefaultBatchSize = 10000
+
+// LogList is the v3 log list published by Google (all_logs_list.json,
+// log_list.json) and Apple (current_log_list.json).
+type LogList struct {
+	Version          string        `json:"version"`
+	LogListTimestamp string        `json:"log_list_timestamp"`
+	Operators        []LogOperator `json:"operators"`
+}
+
+type LogOperator struct {
+	Name      string              `json:"name"`
+	Email     []string            `json:"email"`
+	Logs      []LogListEntry      `json:"logs"`
+	TiledLogs []TiledLogListEntry `json:"tiled_logs"`
+}
+
+type LogListEntry struct {
+	Description      string            `json:"description"`
+	LogID            string            `json:"log_id"`
+	Key              string            `json:"key"`
+	URL              string            `json:"url"`
+	MMD              int64             `json:"mmd"`
+	State            *LogState         `json:"state"`
+	TemporalInterval *TemporalInterval `json:"temporal_interval"`
+}
+
+// TiledLogListEntry describes a log implementing the static CT API.
+type TiledLogListEntry struct {
+	Description      string            `json:"description"`
+	LogID            string            `json:"log_id"`
+	Key              string            `json:"key"`
+	SubmissionURL    string            `json:"submission_url"`
+	MonitoringURL    string            `json:"monitoring_url"`
+	MMD              int64             `json:"mmd"`
+	State            *LogState         `json:"state"`
+	TemporalInterval *TemporalInterval `json:"temporal_interval"`
+}
+
+// logNameFromDescription turns a log list description such as
+// "Google 'Argon2024' log" into the name we key progress on
+// ("google_argon2024_log"), the same way the old jq/tr/sed pipelines did.
+func logNameFromDescription(description string) string {
+	name := strings.ToLower(description)
+	name = strings.Replace(name, " ", "_", -1)
+	name = strings.Replace(name, "'", "", -1)
+	name = strings.Replace(name, "\\", "", -1)
+	return name
+}
+
+// isLogList reports whether contents is a v3 log list rather than a
+// line-delimited CTLogInfo configuration.
+func isLogList(contents []byte) bool {
+	var list LogList
+	if err := json.Unmarshal(contents, &list); err != nil {
+		return false
+	}
+	return list.Operators != nil
+}
+
+func (list *LogList) configuration() Configuration {
+	res := Configuration{}
+	for _, operator := range list.Operators {
+		for _, entry := range operator.Logs {
+			res = append(res, CTLogInfo{
+				Name:             logNameFromDescription(entry.Description),
+				BaseURL:          entry.URL,
+				BatchSize:        kDefaultBatchSize,
+				LogID:            entry.LogID,
+				Key:              entry.Key,
+				MMD:              entry.MMD,
+				Operator:         operator.Name,
+				State:            entry.State,
+				TemporalInterval: entry.TemporalInterval,
+			})
+		}
+		for _, entry := range operator.TiledLogs {
+			res = append(res, CTLogInfo{
+				Name:             logNameFromDescription(entry.Description),
+				BaseURL:          entry.SubmissionURL,
+				BatchSize:        kDefaultBatchSize,
+				LogID:            entry.LogID,
+				Key:              entry.Key,
+				MMD:              entry.MMD,
+				Operator:         operator.Name,
+				State:            entry.State,
+				TemporalInterval: entry.TemporalInterval,
+				API:              kStaticAPI,
+				MonitoringPrefix: entry.MonitoringURL,
+			})
+		}
+	}
+	return res
+}
+
+func loadLogList(listFile io.Reader, db *gorm.DB) (Configuration, error) {
+	var list LogList
+	if err := json.NewDecoder(listFile).Decode(&list); err != nil {
+		return nil, err
+	}
+	res := list.configuration()
+	for i := range res {
+		loadProgressFromDB(db, &res[i])
+	}
+	return res, nil
+}
+
+// LogState is the "state" object of a log list entry. Exactly one of the
+// fields is set for a well-formed entry.
+type LogState struct {
+	Pending   *LogStateDetail `json:"pending,omitempty"`
+	Qualified *LogStateDetail `json:"qualified,omitempty"`
+	Usable    *LogStateDetail `json:"usable,omitempty"`
+	ReadOnly  *LogStateDetail `json:"readonly,omitempty"`
+	Retired   *LogStateDetail `json:"retired,omitempty"`
+	Rejected  *LogStateDetail `json:"rejected,omitempty"`
+}
+
+type LogStateDetail struct {
+	Timestamp     string         `json:"timestamp"`
+	FinalTreeHead *FinalTreeHead `json:"final_tree_head,omitempty"`
+}
+
+type FinalTreeHead struct {
+	SHA256RootHash string `json:"sha256_root_hash"`
+	TreeSize       int64  `json:"tree_size"`
+}
+
+// Name returns the state as spelled in the log list, or "" when the log has
+// no state.
+func (s *LogState) Name() string {
+	switch {
+	case s == nil:
+		return ""
+	case s.Pending != nil:
+		return "pending"
+	case s.Qualified != nil:
+		return "qualified"
+	case s.Usable != nil:
+		return "usable"
+	case s.ReadOnly != nil:
+		return "readonly"
+	case s.Retired != nil:
+		return "retired"
+	case s.Rejected != nil:
+		return "rejected"
+	}
+	return ""
+}
+
+// isFrozen reports whether the log no longer accepts submissions, so that
+// once we have caught up with it there is nothing left to fetch.
+func (s *LogState) isFrozen() bool {
+	return s != nil && (s.ReadOnly != nil || s.Retired != nil)
+}
+
+// finalTreeSize returns the tree size a read-only log was frozen at.
+func (s *LogState) finalTreeSize() (int64, bool) {
+	if s == nil || s.ReadOnly == nil || s.ReadOnly.FinalTreeHead == nil {
+		return 0, false
+	}
+	return s.ReadOnly.FinalTreeHead.TreeSize, true
+}
+
+// TemporalInterval is the range of certificate expiry dates a temporal shard
+// accepts.
+type TemporalInterval struct {
+	StartInclusive time.Time `json:"start_inclusive"`
+	EndExclusive   time.Time `json:"end_exclusive"`
+}
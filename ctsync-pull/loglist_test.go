@@ -0,0 +1,116 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testLogList = `{
+  "version": "30.5",
+  "log_list_timestamp": "2024-01-16T12:54:43Z",
+  "operators": [
+    {
+      "name": "Google",
+      "email": ["google-ct-logs@googlegroups.com"],
+      "logs": [
+        {
+          "description": "Google 'Argon2024' log",
+          "log_id": "7s3QZNXbGs7FXLedtM0TojKHRny87N7DUUhZRnEftZs=",
+          "key": "MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEHblsqctplMVc5ramA7vSuNxUQxcomQwGAVAdnWTAWUYr3MgDHQW0LagJ95lB7QT75Ve6JgT2EVLOFGU7L3YrwA==",
+          "url": "https://ct.googleapis.com/logs/us1/argon2024/",
+          "mmd": 86400,
+          "state": {"usable": {"timestamp": "2022-11-30T17:00:00Z"}},
+          "temporal_interval": {
+            "start_inclusive": "2024-01-01T00:00:00Z",
+            "end_exclusive": "2025-01-01T00:00:00Z"
+          }
+        }
+      ]
+    },
+    {
+      "name": "Cloudflare",
+      "email": ["ct-logs@cloudflare.com"],
+      "logs": [
+        {
+          "description": "Cloudflare 'Nimbus2024' Log",
+          "log_id": "2ra/az+1tiKfm8K7XGvocJFxbLtRhIU0vaQ9MEjX+6s=",
+          "key": "MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEd7Gbe4/mizX+OpIpLayKjVGKJfyTttegiyk3cR0zyswz6ii5H+Ksw6ld3Ze+9p6UJd02gdHrXSnDK0TxW8oVSA==",
+          "url": "https://ct.cloudflare.com/logs/nimbus2024/",
+          "mmd": 86400
+        }
+      ]
+    }
+  ]
+}`
+
+func TestLogNameFromDescription(t *testing.T) {
+	tests := map[string]string{
+		"Google 'Argon2024' log":      "google_argon2024_log",
+		"Cloudflare 'Nimbus2024' Log": "cloudflare_nimbus2024_log",
+		"DigiCert Yeti2024 Log":       "digicert_yeti2024_log",
+	}
+	for description, expected := range tests {
+		if name := logNameFromDescription(description); name != expected {
+			t.Errorf("%q: expected %q, got %q", description, expected, name)
+		}
+	}
+}
+
+func TestIsLogList(t *testing.T) {
+	if !isLogList([]byte(testLogList)) {
+		t.Error("log list not detected")
+	}
+	line := `{"name":"google_argon2024_log","url":"https://ct.googleapis.com/logs/us1/argon2024/","batch_size":10000}`
+	if isLogList([]byte(line + "\n" + line)) {
+		t.Error("line-delimited configuration detected as log list")
+	}
+}
+
+func TestLoadLogList(t *testing.T) {
+	db := newEmptyDatabase()
+	defer db.Close()
+	config, err := loadLogList(strings.NewReader(testLogList), db)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(config) != 2 {
+		t.Fatalf("expected 2 logs, got %d", len(config))
+	}
+	argon := config[0]
+	if argon.Name != "google_argon2024_log" || argon.BaseURL != "https://ct.googleapis.com/logs/us1/argon2024/" {
+		t.Errorf("unexpected log: %+v", argon)
+	}
+	if argon.BatchSize != kDefaultBatchSize || argon.MMD != 86400 || argon.Operator != "Google" {
+		t.Errorf("unexpected log: %+v", argon)
+	}
+	if argon.Key == "" || argon.LogID == "" {
+		t.Errorf("key or log id dropped: %+v", argon)
+	}
+	if argon.State.Name() != "usable" || argon.TemporalInterval == nil {
+		t.Errorf("state or temporal interval dropped: %+v", argon)
+	}
+	if argon.shardExpired(argon.TemporalInterval.EndExclusive) {
+		t.Error("shard expired before its MMD passed")
+	}
+	if !argon.shardExpired(argon.TemporalInterval.EndExclusive.Add(25 * time.Hour)) {
+		t.Error("shard not expired after its MMD passed")
+	}
+	if config[1].shardExpired(time.Now()) {
+		t.Error("log without temporal interval expired")
+	}
+}
@@ -15,16 +15,18 @@
 package main
 
 import (
+	"database/sql"
 	"flag"
+	"fmt"
 	"github.com/pkg/profile"
-	"github.com/teamnsrg/zcrypto/ct"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"syscall"
+	"time"
 
-	//"strings"
 	"sync"
 
 	"github.com/jinzhu/gorm"
@@ -32,8 +34,6 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-var logger = log.New()
-
 func updateCTLogInfoInDB(db *gorm.DB, config CTLogInfo) {
 	var logConfig CTLogInfo
 	db.Where("name = ?", config.Name).First(&logConfig)
@@ -44,10 +44,33 @@ func updateCTLogInfoInDB(db *gorm.DB, config CTLogInfo) {
 	logConfig.BaseURL = config.BaseURL
 	logConfig.BatchSize = config.BatchSize
 	logConfig.LastIndex = config.LastIndex
+	if config.TunedBatchSize > 0 {
+		logConfig.TunedBatchSize = config.TunedBatchSize
+		logConfig.TunedFetchers = config.TunedFetchers
+	}
+	logConfig.SyncState = config.SyncState
+	logConfig.SyncError = config.SyncError
+	logConfig.RetryAt = config.RetryAt
+	if config.Complete {
+		logConfig.Complete = true
+	}
+	if config.STHTimestamp > logConfig.STHTimestamp {
+		logConfig.STHTreeSize = config.STHTreeSize
+		logConfig.STHTimestamp = config.STHTimestamp
+		logConfig.STHRootHash = config.STHRootHash
+	}
+	if config.AuditTreeSize >= logConfig.AuditTreeSize {
+		logConfig.AuditTreeSize = config.AuditTreeSize
+		logConfig.AuditHashes = config.AuditHashes
+		logConfig.AuditPending = config.AuditPending
+	}
 	db.Save(&logConfig)
 	if db.Error != nil {
 		log.Fatalf("error in updating database: %v", db.Error)
 	}
+	if err := saveGapsToDB(db, config); err != nil {
+		log.Fatalf("error in updating gaps: %v", err)
+	}
 }
 
 func updateDBWithCTLogInfo(db *gorm.DB, in <-chan CTLogInfo, wg *sync.WaitGroup) {
@@ -57,45 +80,36 @@ func updateDBWithCTLogInfo(db *gorm.DB, in <-chan CTLogInfo, wg *sync.WaitGroup)
 	}
 }
 
-func updateLogInfoFromUpdater(updater chan int64, l CTLogInfo, logInfoOut chan CTLogInfo) {
-	for {
-		update := <-updater
-		l.LastIndex = update
-		logInfoOut <- l
+func discardCTLogInfo(in <-chan CTLogInfo, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for range in {
 	}
 }
 
-
-func setRLimitAtLeast(limit uint64) {
-	var rLimit syscall.Rlimit
-	err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rLimit)
-	if err != nil {
-		log.Error("error getting rlimit ", err)
-	}
-
-	if rLimit.Cur >= limit {
-		log.Infof("rlimit already sufficient: %d", rLimit.Cur)
-		return
-	}
-
-	if rLimit.Max < limit {
-		log.Fatal("system disallows rlimit 10000 or greater, try sudo")
-	}
-
-	rLimit.Cur = limit
-	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rLimit); err != nil {
-		log.Fatalf("unable to set rlimit to %d", limit)
+// drainUpdater discards the scanners' progress reports: progress is only
+// saved at checkpoints, once the entries below it are durable.
+func drainUpdater(updater chan int64) {
+	for range updater {
 	}
 }
 
 type runState struct {
 	sync.RWMutex
 	running bool
+	// stopped is closed by stopRunning to cut sleeps short.
+	stopped chan struct{}
+}
+
+func newRunState() *runState {
+	return &runState{running: true, stopped: make(chan struct{})}
 }
 
 func (r *runState) stopRunning() {
 	r.Lock()
 	defer r.Unlock()
+	if r.running {
+		close(r.stopped)
+	}
 	r.running = false
 }
 
@@ -105,15 +119,58 @@ func (r *runState) checkRunning() bool {
 	return r.running
 }
 
+// sleep waits for d, or until stopRunning is called. It reports whether we
+// are still running.
+func (r *runState) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+	case <-r.stopped:
+	}
+	return r.checkRunning()
+}
+
 
 
 func main() {
 	configFile := flag.String("config", "config.json", "The configuration file for log servers")
 	dbPath := flag.String("db", "ctsync-pull.db", "Path to the SQLite file that stores log sync progress")
 	numProcs := flag.Int("gomaxprocs", 1, "Number of processes to use")
-	numFetch := flag.Int("fetchers", 1, "Number of workers assigned to fetch certificates from each server")
+	numFetch := flag.Int("fetchers", 1, "Maximum number of parallel get-entries requests to each server; fewer are used while a log is slow or rate limits us")
 	numMatch := flag.Int("matchers", 1, "Number of workers assigned to parse certs from each server")
 	outputDirectory := flag.String("output-dir", "deduped-certs", "Output directory to store certificates")
+	sinksFile := flag.String("sinks", "", "JSON list of outputs to write certificates to (type, dir, on_error, ...); replaces the CSV output in -output-dir")
+	maxOpenFiles := flag.Int("max-open-files", 0, "Maximum number of output files kept open across all outputs; the least recently used are closed, and reopened when needed (0 = one per partition, within the open file limit)")
+	audit := flag.Bool("audit", false, "Recompute each log's Merkle tree over the downloaded entries and check it against the STH")
+	dedupBackend := flag.String("dedup", "postgres", "Where to record which certificates have been written: postgres, sqlite (the -db file), bolt (the -dedup-path file) or memory")
+	dedupPath := flag.String("dedup-path", "ctsync-dedup.bolt", "Path to the bolt file used by -dedup bolt")
+	useBloom := flag.Bool("bloom", false, "Keep a bloom filter of seen certificates next to the dedup backend to skip lookups of new ones")
+	bloomPath := flag.String("bloom-file", "ctsync-dedup.bloom", "Where the bloom filter is saved on shutdown and reloaded from on start")
+	bloomCapacity := flag.Uint64("bloom-capacity", 100000000, "Number of certificates the bloom filter is sized for")
+	bloomFPRate := flag.Float64("bloom-fp-rate", 0.01, "Target false positive rate of the bloom filter at -bloom-capacity")
+	postgresDSN := flag.String("postgres-dsn", "", "Postgres connection string for the deduplication database (default: local socket, or the libpq PGHOST, PGUSER, ... environment variables)")
+	postgresConfigFile := flag.String("postgres-config", "", "JSON file with Postgres connection settings (host, port, sslmode, password_file, max_open_conns, ...)")
+	status := flag.Bool("status", false, "Print the sync status of every configured log and exit")
+	gaps := flag.Bool("gaps", false, "Print the ranges each configured log failed to serve, including permanently missing ones, and exit")
+	states := flag.String("states", "qualified,usable,readonly,retired", "Comma-separated log states to sync (pending, qualified, usable, readonly, retired, rejected); logs without a state are always synced")
+	logName := flag.String("log", "", "Only sync the log with this name, whatever its state")
+	start := flag.Int64("start", -1, "With -log, download from this index instead of the saved progress; progress is then not saved, and certificates are only deduplicated within the run")
+	end := flag.Int64("end", -1, "With -log, stop before this index and exit; progress is then not saved, and certificates are only deduplicated within the run")
+	once := flag.Bool("once", false, "Exit once every log is caught up instead of polling for new entries")
+	logRPS := flag.Float64("log-rps", 0, "Maximum requests per second to each log, unless the log's requests_per_second says otherwise (0: unlimited)")
+	logConcurrency := flag.Int("log-concurrency", 0, "Maximum requests in flight to each log, unless the log's max_concurrent_requests says otherwise (0: unlimited)")
+	operatorRPS := flag.Float64("operator-rps", 0, "Maximum requests per second to all logs of one operator together (0: unlimited)")
+	operatorConcurrency := flag.Int("operator-concurrency", 0, "Maximum requests in flight to all logs of one operator together (0: unlimited)")
+	operatorFetchers := flag.Int("operator-fetchers", 0, "Maximum parallel get-entries requests to all logs of one operator together (0: -fetchers per log)")
+	operatorConfigFile := flag.String("operator-config", "", "JSON list of per-operator limits (name, requests_per_second, max_concurrent_requests, fetchers) overriding the -operator-* flags")
+	httpProxy := flag.String("http-proxy", "", "Proxy URL for requests to logs (default: HTTPS_PROXY and friends from the environment)")
+	caBundle := flag.String("ca-bundle", "", "PEM file of CA certificates to trust for log connections in addition to the system roots")
+	httpTimeout := flag.Duration("http-timeout", kDefaultHTTPTimeout, "Timeout of a single request to a log, not counting the wait for rate limits")
+	httpIdleConns := flag.Int("http-idle-conns", kDefaultIdleConns, "Keep-alive connections kept open to each log host")
+	disableHTTP2 := flag.Bool("disable-http2", false, "Talk HTTP/1.1 to logs even if they support HTTP/2")
+	userAgent := flag.String("user-agent", kDefaultUserAgent, "User-Agent sent to logs")
+	contact := flag.String("contact", "", "Email or URL appended to the User-Agent so log operators can reach you")
+	globalRPS := flag.Float64("global-rps", 0, "Maximum requests per second to all logs together (0: unlimited)")
+	globalConcurrency := flag.Int("global-concurrency", 0, "Maximum requests in flight to all logs together (0: unlimited)")
 
 	var memProfile, cpuProfile bool
 	flag.BoolVar(&memProfile, "mem-profile", false, "run memory profiling")
@@ -121,6 +178,12 @@ func main() {
 
 	flag.Parse()
 
+	if _, err := bloomFilterBits(*bloomCapacity, *bloomFPRate); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid bloom filter size: %s\n", err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	if cpuProfile {
 		defer profile.Start(profile.CPUProfile, profile.ProfilePath(".")).Stop()
 	}
@@ -138,17 +201,77 @@ func main() {
 		log.Fatalf("could not open sqlite3 db: %s", err)
 	}
 	defer db.Close()
-	db.AutoMigrate(&CTLogInfo{})
+	// Progress updates and the sqlite dedup backend write from different
+	// goroutines; one connection serializes them instead of failing with
+	// "database is locked".
+	db.DB().SetMaxOpenConns(1)
+	db.AutoMigrate(&CTLogInfo{}, &LogGap{})
 
 	// Read configuration file
 	configuration, err := readAndLoadConfiguration(*configFile, db)
 	if err != nil {
 		log.Fatalf("could not load configuration file: %s", err)
 	}
+	if *logName != "" {
+		configuration = configuration.withName(*logName)
+		if len(configuration) == 0 {
+			log.Fatalf("no log named %q in %s", *logName, *configFile)
+		}
+	} else if *start >= 0 || *end >= 0 {
+		log.Fatal("-start and -end require -log")
+	} else {
+		configuration = configuration.withStates(strings.Split(*states, ","))
+	}
+	// A one-off range download leaves the saved progress alone.
+	saveProgress := *start < 0 && *end < 0
+
+	if *status {
+		printStatus(os.Stdout, configuration)
+		return
+	}
+	if *gaps {
+		printGaps(os.Stdout, configuration)
+		return
+	}
+
+	// Logs of one operator share its request budget.
+	var operatorOverrides map[string]OperatorInfo
+	if *operatorConfigFile != "" {
+		if operatorOverrides, err = readOperatorConfig(*operatorConfigFile); err != nil {
+			log.Fatalf("could not load operator configuration: %s", err)
+		}
+	}
+	operators := configuration.operators(OperatorInfo{
+		RequestsPerSecond:     *operatorRPS,
+		MaxConcurrentRequests: *operatorConcurrency,
+		Fetchers:              *operatorFetchers,
+	}, operatorOverrides)
+	for _, operator := range sortedOperators(operators) {
+		log.Infof("operator %s: %d logs", operator.Name, len(operator.Logs))
+	}
+	if ctHTTPClient, err = newHTTPClient(httpOptions{
+		proxy:        *httpProxy,
+		caBundle:     *caBundle,
+		timeout:      *httpTimeout,
+		maxIdleConns: *httpIdleConns,
+		disableHTTP2: *disableHTTP2,
+		userAgent:    *userAgent,
+		contact:      *contact,
+	}, requestLimits); err != nil {
+		log.Fatalf("could not set up HTTP client: %s", err)
+	}
+	if *contact == "" {
+		log.Warn("no -contact given; log operators ask scrapers to identify themselves")
+	}
+	requestLimits.configure(configuration, operators, rateLimitOptions{
+		globalRPS:         *globalRPS,
+		globalConcurrency: *globalConcurrency,
+		logRPS:            *logRPS,
+		logConcurrency:    *logConcurrency,
+	})
 
 	// Clean up correctly
-	running := runState{}
-	running.running = true
+	running := newRunState()
 	signalChannel := make(chan os.Signal, 3)
 	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM, syscall.SIGABRT)
 	var signalWg sync.WaitGroup
@@ -163,36 +286,90 @@ func main() {
 
 	var pushWg sync.WaitGroup
 	pushWg.Add(1)
-	outputChannel := make(chan *ct.LogEntry, len(configuration))
-	dir := filepath.Join(*outputDirectory)
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		os.MkdirAll(dir, os.ModePerm)
+	outputChannel := make(chan outputItem, len(configuration))
+	sinkConfigs := []SinkConfig{{Type: kCSVSink, Dir: filepath.Join(*outputDirectory)}}
+	if *sinksFile != "" {
+		if sinkConfigs, err = readSinkConfig(*sinksFile); err != nil {
+			log.Fatalf("could not load sink configuration: %s", err)
+		}
+	}
+	if *maxOpenFiles < 0 {
+		log.Fatal("-max-open-files must not be negative")
 	}
+	if *maxOpenFiles == 0 {
+		*maxOpenFiles = defaultMaxOpenFiles(sinkConfigs)
+	}
+	openFiles = newFileLRU(*maxOpenFiles)
 
-	setRLimitAtLeast(100000)
-	go pushToFile(outputChannel, &pushWg, dir)
+	var postgresConfig PostgresConfig
+	if *postgresConfigFile != "" {
+		if postgresConfig, err = readPostgresConfig(*postgresConfigFile); err != nil {
+			log.Fatalf("could not load postgres configuration: %s", err)
+		}
+	}
+	if *postgresDSN != "" {
+		postgresConfig.DSN = *postgresDSN
+	}
+	deduper, err := newDeduper(dedupOptions{
+		backend:       *dedupBackend,
+		postgres:      func() (*sql.DB, error) { return openPostgres(postgresConfig) },
+		sqlite:        db.DB(),
+		path:          *dedupPath,
+		bloom:         *useBloom,
+		bloomPath:     *bloomPath,
+		bloomCapacity: *bloomCapacity,
+		bloomFPRate:   *bloomFPRate,
+	})
+	if err != nil {
+		log.Fatalf("could not open %s dedup backend: %s", *dedupBackend, err)
+	}
+	if !saveProgress {
+		deduper = newRangeDeduper(deduper)
+	}
+	defer deduper.Close()
+	// The deduper knows which checkpoints were committed, and so which
+	// output written before a crash to keep.
+	sink, err := newFanOutSink(sinkConfigs, deduper.Committed)
+	if err != nil {
+		log.Fatalf("could not open output: %s", err)
+	}
 
 	// Start goroutine that writes indicies to SQLite
 	logInfoUpdate := make(chan CTLogInfo)
 	var dbWg sync.WaitGroup
 	dbWg.Add(1)
-	go updateDBWithCTLogInfo(db, logInfoUpdate, &dbWg)
+	if saveProgress {
+		go updateDBWithCTLogInfo(db, logInfoUpdate, &dbWg)
+	} else {
+		go discardCTLogInfo(logInfoUpdate, &dbWg)
+	}
+
+	go pushToSinks(outputChannel, logInfoUpdate, &pushWg, sink, deduper)
 
 	// Start goroutines that monitor a CTLog
+	opts := pullOptions{
+		numMatch:  *numMatch,
+		numFetch:  *numFetch,
+		audit:     *audit,
+		start:     *start,
+		end:       *end,
+		once:      *once,
+		operators: operators,
+	}
 	var pullWg sync.WaitGroup
 	for i := 0; i < len(configuration); i++ {
 		pullWg.Add(1)
 		updater := make(chan int64)
-		go pullFromCT(configuration[i], outputChannel, updater, logInfoUpdate, *numMatch, *numFetch, &pullWg, &running)
-		go updateLogInfoFromUpdater(updater, configuration[i], logInfoUpdate)
+		go pullFromCT(configuration[i], outputChannel, updater, opts, &pullWg, running)
+		go drainUpdater(updater)
 	}
 
 	// Run until done pulling.
 	pullWg.Wait()
-	close(logInfoUpdate)
-	dbWg.Wait()
 	close(outputChannel)
 	pushWg.Wait()
+	close(logInfoUpdate)
+	dbWg.Wait()
 	close(signalChannel)
 	signalWg.Wait()
 }
@@ -0,0 +1,125 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+// RFC 6962 section 2.1 Merkle tree hashing.
+
+func leafHash(leafInput []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(leafInput)
+	return h.Sum(nil)
+}
+
+func hashChildren(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// verifyConsistency checks a consistency proof between two tree heads, as
+// described in RFC 9162 section 2.1.4.2.
+func verifyConsistency(first, second int64, firstRoot, secondRoot []byte, proof [][]byte) error {
+	switch {
+	case first > second:
+		return errors.New("first tree is larger than second tree")
+	case first == second:
+		if len(proof) != 0 {
+			return errors.New("non-empty proof for trees of equal size")
+		}
+		if !bytes.Equal(firstRoot, secondRoot) {
+			return errors.New("different roots for trees of equal size")
+		}
+		return nil
+	case first == 0:
+		return nil
+	case len(proof) == 0:
+		return errors.New("empty consistency proof")
+	}
+
+	if first&(first-1) == 0 {
+		proof = append([][]byte{firstRoot}, proof...)
+	}
+	fn, sn := first-1, second-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return errors.New("consistency proof too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = hashChildren(c, fr)
+			sr = hashChildren(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = hashChildren(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 {
+		return errors.New("consistency proof too short")
+	}
+	if !bytes.Equal(fr, firstRoot) {
+		return errors.New("consistency proof does not match first root")
+	}
+	if !bytes.Equal(sr, secondRoot) {
+		return errors.New("consistency proof does not match second root")
+	}
+	return nil
+}
+
+// compactRange holds the roots of the perfect subtrees covering leaves
+// [0, size), largest first. It is enough to extend the tree one leaf at a
+// time and compute its root without keeping any leaves around.
+type compactRange struct {
+	size   int64
+	hashes [][]byte
+}
+
+func (r *compactRange) append(hash []byte) {
+	for s := r.size; s&1 == 1; s >>= 1 {
+		hash = hashChildren(r.hashes[len(r.hashes)-1], hash)
+		r.hashes = r.hashes[:len(r.hashes)-1]
+	}
+	r.hashes = append(r.hashes, hash)
+	r.size++
+}
+
+func (r *compactRange) root() []byte {
+	if len(r.hashes) == 0 {
+		empty := sha256.Sum256(nil)
+		return empty[:]
+	}
+	root := r.hashes[len(r.hashes)-1]
+	for i := len(r.hashes) - 2; i >= 0; i-- {
+		root = hashChildren(r.hashes[i], root)
+	}
+	return root
+}
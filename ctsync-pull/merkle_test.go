@@ -0,0 +1,162 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/teamnsrg/zcrypto/ct"
+)
+
+// referenceRoot and referenceSubproof follow the recursive definitions of
+// RFC 6962 sections 2.1 and 2.1.2.
+func referenceRoot(leaves [][]byte) []byte {
+	if len(leaves) == 1 {
+		return leafHash(leaves[0])
+	}
+	k := 1
+	for k*2 < len(leaves) {
+		k *= 2
+	}
+	return hashChildren(referenceRoot(leaves[:k]), referenceRoot(leaves[k:]))
+}
+
+func referenceSubproof(m int, leaves [][]byte, b bool) [][]byte {
+	n := len(leaves)
+	if m == n {
+		if b {
+			return nil
+		}
+		return [][]byte{referenceRoot(leaves)}
+	}
+	k := 1
+	for k*2 < n {
+		k *= 2
+	}
+	if m <= k {
+		return append(referenceSubproof(m, leaves[:k], b), referenceRoot(leaves[k:]))
+	}
+	return append(referenceSubproof(m-k, leaves[k:], false), referenceRoot(leaves[:k]))
+}
+
+func testLeaves(n int) [][]byte {
+	leaves := make([][]byte, n)
+	for i := range leaves {
+		leaves[i] = []byte(fmt.Sprintf("leaf %d", i))
+	}
+	return leaves
+}
+
+func TestVerifyConsistency(t *testing.T) {
+	leaves := testLeaves(40)
+	for second := 1; second <= len(leaves); second++ {
+		secondRoot := referenceRoot(leaves[:second])
+		for first := 1; first <= second; first++ {
+			firstRoot := referenceRoot(leaves[:first])
+			var proof [][]byte
+			if first < second {
+				proof = referenceSubproof(first, leaves[:second], true)
+			}
+			if err := verifyConsistency(int64(first), int64(second), firstRoot, secondRoot, proof); err != nil {
+				t.Errorf("%d -> %d: %s", first, second, err)
+			}
+			if first < second {
+				if err := verifyConsistency(int64(first), int64(second), firstRoot, leafHash([]byte("forged")), proof); err == nil {
+					t.Errorf("%d -> %d: forged second root accepted", first, second)
+				}
+			}
+		}
+	}
+	if err := verifyConsistency(5, 5, referenceRoot(leaves[:5]), referenceRoot(leaves[1:6]), nil); err == nil {
+		t.Error("split view accepted")
+	}
+}
+
+func TestCompactRange(t *testing.T) {
+	leaves := testLeaves(70)
+	var r compactRange
+	for i, leaf := range leaves {
+		r.append(leafHash(leaf))
+		if !bytes.Equal(r.root(), referenceRoot(leaves[:i+1])) {
+			t.Errorf("wrong root for tree size %d", i+1)
+		}
+	}
+}
+
+func TestVerifyConsistencyWithLastSTH(t *testing.T) {
+	leaves := testLeaves(8)
+	root := referenceRoot(leaves[:8])
+	l := CTLogInfo{STHTreeSize: 8, STHTimestamp: 2000, STHRootHash: base64.StdEncoding.EncodeToString(root)}
+	sth := func(size int, timestamp uint64) *LogServerConnection {
+		c := &LogServerConnection{sth: &ct.SignedTreeHead{TreeSize: uint64(size), Timestamp: timestamp}, treeSize: int64(size)}
+		copy(c.sth.SHA256RootHash[:], referenceRoot(leaves[:size]))
+		return c
+	}
+	if err := verifyConsistencyWithLastSTH(l, sth(8, 3000)); err != nil {
+		t.Errorf("same STH: %s", err)
+	}
+	err := verifyConsistencyWithLastSTH(l, sth(5, 1000))
+	if _, inconsistent := err.(*inconsistentLogError); err == nil || inconsistent {
+		t.Errorf("older, smaller STH: %v", err)
+	}
+	err = verifyConsistencyWithLastSTH(l, sth(5, 3000))
+	if _, inconsistent := err.(*inconsistentLogError); !inconsistent {
+		t.Errorf("newer, smaller STH: %v", err)
+	}
+	forged := sth(8, 3000)
+	forged.sth.SHA256RootHash[0] ^= 1
+	err = verifyConsistencyWithLastSTH(l, forged)
+	if _, inconsistent := err.(*inconsistentLogError); !inconsistent {
+		t.Errorf("split view: %v", err)
+	}
+}
+
+func TestLogAuditorAcrossGap(t *testing.T) {
+	leaves := testLeaves(10)
+	l := CTLogInfo{Name: "test"}
+	auditor, err := newLogAuditor(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, leaf := range leaves {
+		if i < 3 || i >= 5 {
+			auditor.addLeafInput(int64(i), leaf)
+		}
+	}
+	l.LastIndex = 10
+	l.Gaps = []LogGap{{Start: 3, End: 5}}
+	auditor.save(&l)
+	if l.AuditTreeSize != 3 {
+		t.Fatalf("expected the audit to wait at 3, got %d", l.AuditTreeSize)
+	}
+
+	// A restart resumes the audit with the entries past the gap.
+	if auditor, err = newLogAuditor(l); err != nil {
+		t.Fatal(err)
+	}
+	auditor.addLeafInput(3, leaves[3])
+	auditor.addLeafInput(4, leaves[4])
+	if auditor.size() != 10 || !bytes.Equal(auditor.tree.root(), referenceRoot(leaves)) {
+		t.Errorf("unexpected audit of size %d", auditor.size())
+	}
+
+	l.Gaps[0].Missing = true
+	if _, err := newLogAuditor(l); err == nil {
+		t.Error("resumed an audit waiting for a gap given up on")
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// OperatorInfo is the budget shared by every log of one operator, so that
+// syncing many shards at once does not multiply the load on the operator.
+// Zero fields are unlimited.
+type OperatorInfo struct {
+	Name                  string  `json:"name"`
+	RequestsPerSecond     float64 `json:"requests_per_second"`
+	MaxConcurrentRequests int     `json:"max_concurrent_requests"`
+	// Fetchers caps the parallel get-entries requests to all of the
+	// operator's logs together.
+	Fetchers int `json:"fetchers"`
+
+	// Logs are the names of the configured logs run by the operator.
+	Logs []string `json:"-"`
+	pool fetcherPool
+}
+
+// fetcherPool hands out an operator's get-entries slots; a nil pool never
+// blocks.
+type fetcherPool chan struct{}
+
+func (p fetcherPool) acquire() {
+	if p != nil {
+		p <- struct{}{}
+	}
+}
+
+func (p fetcherPool) release() {
+	if p != nil {
+		<-p
+	}
+}
+
+// readOperatorConfig reads a JSON list of OperatorInfo that override the
+// defaults for single operators.
+func readOperatorConfig(path string) (map[string]OperatorInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var list []OperatorInfo
+	if err := json.NewDecoder(f).Decode(&list); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	res := make(map[string]OperatorInfo)
+	for _, operator := range list {
+		res[operator.Name] = operator
+	}
+	return res, nil
+}
+
+// operators groups the configured logs by operator. Each operator gets the
+// limits of its entry in overrides, and those of defaults where that entry
+// has none. Logs without an operator are not grouped.
+func (c Configuration) operators(defaults OperatorInfo, overrides map[string]OperatorInfo) map[string]*OperatorInfo {
+	res := make(map[string]*OperatorInfo)
+	for _, l := range c {
+		if l.Operator == "" {
+			continue
+		}
+		operator, ok := res[l.Operator]
+		if !ok {
+			info := overrides[l.Operator]
+			if info.RequestsPerSecond == 0 {
+				info.RequestsPerSecond = defaults.RequestsPerSecond
+			}
+			if info.MaxConcurrentRequests == 0 {
+				info.MaxConcurrentRequests = defaults.MaxConcurrentRequests
+			}
+			if info.Fetchers == 0 {
+				info.Fetchers = defaults.Fetchers
+			}
+			info.Name = l.Operator
+			info.Logs = nil
+			if info.Fetchers > 0 {
+				info.pool = make(fetcherPool, info.Fetchers)
+			}
+			operator = &info
+			res[l.Operator] = operator
+		}
+		operator.Logs = append(operator.Logs, l.Name)
+	}
+	return res
+}
+
+// sortedOperators returns the operators by name.
+func sortedOperators(operators map[string]*OperatorInfo) []*OperatorInfo {
+	var res []*OperatorInfo
+	for _, operator := range operators {
+		res = append(res, operator)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
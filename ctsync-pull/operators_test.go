@@ -0,0 +1,76 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigurationOperators(t *testing.T) {
+	config := Configuration{
+		{Name: "argon", Operator: "Google"},
+		{Name: "xenon", Operator: "Google"},
+		{Name: "nimbus", Operator: "Cloudflare"},
+		{Name: "private"},
+	}
+	overrides := map[string]OperatorInfo{"Google": {Name: "Google", Fetchers: 4}}
+	operators := config.operators(OperatorInfo{Fetchers: 2, RequestsPerSecond: 1}, overrides)
+	if len(operators) != 2 {
+		t.Fatalf("expected 2 operators, got %d", len(operators))
+	}
+	google := operators["Google"]
+	if len(google.Logs) != 2 || google.Fetchers != 4 || google.RequestsPerSecond != 1 || cap(google.pool) != 4 {
+		t.Errorf("unexpected Google budget: %+v", google)
+	}
+	cloudflare := operators["Cloudflare"]
+	if len(cloudflare.Logs) != 1 || cloudflare.Fetchers != 2 || cloudflare.RequestsPerSecond != 1 {
+		t.Errorf("unexpected Cloudflare budget: %+v", cloudflare)
+	}
+
+	// Both Google shards share one pool, and neither fetches with more
+	// parallel requests than the whole operator may.
+	argon := newBatchTuner(config[0], 8, google)
+	xenon := newBatchTuner(config[1], 8, google)
+	if argon.pool != xenon.pool || argon.maxFetchers != 4 {
+		t.Errorf("shards do not share the operator budget: %+v %+v", argon, xenon)
+	}
+	if private := newBatchTuner(config[3], 8, operators[""]); private.pool != nil || private.maxFetchers != 8 {
+		t.Errorf("log without operator was limited: %+v", private)
+	}
+}
+
+func TestReadOperatorConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctsync-operators-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "operators.json")
+	contents := `[{"name":"Google","requests_per_second":5,"max_concurrent_requests":8,"fetchers":16}]`
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	overrides, err := readOperatorConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	google := overrides["Google"]
+	if google.RequestsPerSecond != 5 || google.MaxConcurrentRequests != 8 || google.Fetchers != 16 {
+		t.Errorf("unexpected operator config: %+v", google)
+	}
+}
@@ -2,27 +2,25 @@ package main
 
 import (
 	"crypto/sha256"
-	"database/sql"
-	"encoding/base64"
-	"encoding/csv"
 	"encoding/hex"
-	"fmt"
-	"github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
 	"github.com/teamnsrg/zcrypto/ct"
-	"io/ioutil"
-	"os"
-	"path/filepath"
-	"runtime"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 )
 
-type csvFileWriter struct {
-	csvWriter *csv.Writer
-	osFile    *os.File
+// outputItem is a certificate to write or, if checkpoint is set, a log's
+// progress to save once everything sent before it is durable.
+type outputItem struct {
+	logName    string
+	entry      *ct.LogEntry
+	checkpoint *CTLogInfo
+}
+
+func newCheckpoint(l CTLogInfo) outputItem {
+	// The caller keeps changing its gaps.
+	l.Gaps = append([]LogGap(nil), l.Gaps...)
+	return outputItem{checkpoint: &l}
 }
 
 type certHashes struct {
@@ -30,91 +28,39 @@ type certHashes struct {
 	TBS_NO_CT_SHA256 string
 }
 
-func selectBuilder(values []string) string {
-	var str strings.Builder
-	str.WriteString("SELECT sha256 FROM downloaded_certs WHERE sha256 IN (")
-
-	for idx, sha256 := range values {
-		str.WriteString("'\\x")
-		str.WriteString(sha256)
-		if idx == len(values)-1 {
-			str.WriteString("')")
-		} else {
-			str.WriteString("',")
-		}
-	}
-
-	return str.String()
-}
-
-func insertBuilder(values []*certHashes) string {
-	var str strings.Builder
-	str.WriteString("INSERT INTO downloaded_certs (sha256,tbs_no_ct_sha256) VALUES")
-
-	for idx, hashes := range values {
-
-		str.WriteString(" ('\\x")
-		str.WriteString(hashes.SHA256)
-		str.WriteString("','\\x")
-		str.WriteString(hashes.TBS_NO_CT_SHA256)
-		if idx == len(values)-1 {
-			str.WriteString("')")
-		} else {
-			str.WriteString("'),")
-		}
-	}
-
-	return str.String()
-}
-
+// logEntryWriter batches the incoming certificates, drops those the deduper
+// has seen and hands the rest to sink.
 type logEntryWriter struct {
-	ctRecords     []*ct.LogEntry
+	records       []outputRecord
 	seenInBatch   map[string]struct{}
-	db            *sql.DB
-	yearWriters   map[string]map[string]*csvFileWriter
-	outputDir     string
+	deduper       Deduper
+	sink          OutputSink
 	lastWriteTime time.Time
 }
 
 const DB_INSERT_THRESHOLD = 1000
 const WRITER_TIMER_TIME = 30 * time.Second
 
-func (c *logEntryWriter) Open() {
-	c.ctRecords = make([]*ct.LogEntry, 0)
+func (c *logEntryWriter) Open(deduper Deduper, sink OutputSink) {
+	c.records = make([]outputRecord, 0)
 	c.seenInBatch = make(map[string]struct{})
 	c.lastWriteTime = time.Now()
-
-	cmdString := "user=ctdownloader dbname=ctdownload sslmode=disable"
-
-	if runtime.GOOS == "linux" {
-		cmdString = "user=ctdownloader dbname=ctdownload sslmode=disable host=/var/run/postgresql"
-	}
-
-	var err error
-	c.db, err = sql.Open("postgres", cmdString)
-	if err != nil {
-		log.Fatal(err)
-	}
-	c.yearWriters = make(map[string]map[string]*csvFileWriter)
+	c.deduper = deduper
+	c.sink = sink
 }
 
 func (c *logEntryWriter) Close() {
-	c.insertAndWriteRecords()
-
-	for _, yearWriter := range c.yearWriters {
-		for _, writer := range yearWriter {
-			writer.csvWriter.Flush()
-			writer.osFile.Close()
-		}
+	c.Checkpoint()
+	if err := c.sink.Close(); err != nil {
+		log.Error(err)
 	}
-	c.db.Close()
 }
 
-func (c *logEntryWriter) insertRecords(indexes []int) error {
-	values := make([]*certHashes, len(indexes))
+func (c *logEntryWriter) hashRecords() []*certHashes {
+	values := make([]*certHashes, len(c.records))
 
-	for i, idx := range indexes {
-		entry := c.ctRecords[idx]
+	for i, record := range c.records {
+		entry := record.entry
 		var sha256Fingerprint, tbsNoCTSHA256 string
 		if entry.Leaf.TimestampedEntry.EntryType == ct.X509LogEntryType {
 			sha256Fingerprint = entry.X509Cert.FingerprintSHA256.Hex()
@@ -128,130 +74,66 @@ func (c *logEntryWriter) insertRecords(indexes []int) error {
 		values[i] = &certHashes{SHA256: sha256Fingerprint, TBS_NO_CT_SHA256: tbsNoCTSHA256}
 	}
 
-	if len(values) > 0 {
-		_, e := c.db.Exec(insertBuilder(values))
-		if err, hasErr := e.(*pq.Error); hasErr {
-			return err
-		}
-	}
-
-	return nil
+	return values
 }
 
-func (c *logEntryWriter) writeRecords(indexes []int) {
-	for _, idx := range indexes {
-		entry := c.ctRecords[idx]
-		chainBytes := make([]byte, 0)
-		chainB64 := make([]string, len(entry.Chain))
-		for i, c := range entry.Chain {
-			chainBytes = append(chainBytes, c...)
-			chainB64[i] = base64.StdEncoding.EncodeToString(c)
-		}
-
-		chainHash := fmt.Sprintf("%x", sha256.Sum256(chainBytes))
-		var leafB64, leafHash, leafTBSnoCTfingerprint, ctLoggedYear string
-		ctTimestamp := time.Unix(int64(entry.Leaf.TimestampedEntry.Timestamp / 1000), 0)
-		ctLoggedYear = strconv.Itoa(ctTimestamp.Year())
-
-		if entry.Leaf.TimestampedEntry.EntryType == ct.X509LogEntryType {
-			leafB64 = base64.StdEncoding.EncodeToString(entry.X509Cert.Raw)
-			leafHash = entry.X509Cert.FingerprintSHA256.Hex()
-			leafTBSnoCTfingerprint = entry.X509Cert.FingerprintNoCT.Hex()
-		} else if entry.Leaf.TimestampedEntry.EntryType == ct.PrecertLogEntryType {
-			leafB64 = base64.StdEncoding.EncodeToString(entry.Precert.Raw)
-			hash := sha256.Sum256(entry.Precert.Raw)
-			leafHash = hex.EncodeToString(hash[:])
-			leafTBSnoCTfingerprint = entry.Precert.TBSCertificate.FingerprintNoCT.Hex()
-		}
-
-		row := []string{
-			leafHash,
-			leafTBSnoCTfingerprint,
-			leafB64,
-			//TODO: Add leaf's parent spki+subject fingerprint
-			chainHash,
-			strings.Join(chainB64, "|"),
-		}
-
-		hashPrefix := leafHash[0:3]
-		_, ok := c.yearWriters[ctLoggedYear]
-		if !ok {
-			c.yearWriters[ctLoggedYear] = make(map[string] *csvFileWriter)
-			os.Mkdir(filepath.Join(c.outputDir, ctLoggedYear), 0755)
-		}
-
-		_, ok = c.yearWriters[ctLoggedYear][hashPrefix]
-		if !ok {
-			filename := hashPrefix + ".csv"
-			filepath := filepath.Join(c.outputDir, ctLoggedYear, filename)
-			outFile, err := os.OpenFile(filepath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-			if err != nil {
-				log.Errorf("unable to open file: %s", filepath)
-				log.Fatal(err)
-			}
-			csvFW := csvFileWriter{csvWriter: csv.NewWriter(outFile), osFile: outFile}
-			c.yearWriters[ctLoggedYear][hashPrefix] = &csvFW
-		}
-
-		c.yearWriters[ctLoggedYear][hashPrefix].csvWriter.Write(row)
+// sync makes everything written so far durable in every sink, then commits
+// the matching dedup inserts. The sinks record the checkpoint with the size
+// of their files, and cut off what was written after the last committed one
+// after a crash.
+func (c *logEntryWriter) sync() {
+	checkpoint, err := newCheckpointID()
+	if err != nil {
+		log.Fatal(err)
 	}
-}
-
-func (c *logEntryWriter) insertAndWriteRecords() {
-	if len(c.ctRecords) == 0 {
-		return
+	if err := c.sink.Flush(checkpoint); err != nil {
+		log.Fatal(err)
 	}
-	// Check which records exist
-	values := make([]string, len(c.ctRecords))
-	for idx, ctRecord := range c.ctRecords {
-		entry := ctRecord
-		if entry.Leaf.TimestampedEntry.EntryType == ct.X509LogEntryType {
-			values[idx] = entry.X509Cert.FingerprintSHA256.Hex()
-		} else if entry.Leaf.TimestampedEntry.EntryType == ct.PrecertLogEntryType {
-			hash := sha256.Sum256(entry.Precert.Raw)
-			values[idx] = hex.EncodeToString(hash[:])
-		}
+	if err := c.deduper.Commit(checkpoint); err != nil {
+		log.Fatal(err)
 	}
-
-	rows, e := c.db.Query(selectBuilder(values))
-	defer rows.Close()
-	if err, hasErr := e.(*pq.Error); hasErr {
-		log.Error(err)
+	if err := c.sink.Committed(); err != nil {
+		log.Fatal(err)
 	}
+}
 
-	included := make(map[string]struct{})
-	for rows.Next() {
-		bytes := make([]byte, 32)
-		err := rows.Scan(&bytes)
-		if err != nil {
-			log.Fatal(err)
-		}
-		sha256 := hex.EncodeToString(bytes)
-		included[sha256] = struct{}{}
-	}
+// Checkpoint returns once every entry received so far is durable.
+func (c *logEntryWriter) Checkpoint() {
+	c.flushBatch()
+	c.sync()
+}
 
-	not_included := make([]int, 0)
-	for idx, sha256 := range values {
-		if _, ok := included[sha256]; !ok {
-			not_included = append(not_included, idx)
-		}
-	}
+func (c *logEntryWriter) flushBatch() {
+	c.insertAndWriteRecords()
+	c.records = make([]outputRecord, 0)
+	c.lastWriteTime = time.Now()
+	c.seenInBatch = make(map[string]struct{})
+}
 
-	if len(not_included) == 0 {
+func (c *logEntryWriter) insertAndWriteRecords() {
+	if len(c.records) == 0 {
 		return
 	}
-
-	// Insert and write the ones that aren't
-	if err := c.insertRecords(not_included); err != nil {
-		log.Error(err)
-		log.Info(not_included)
+	// Only the certificates this batch inserted are written; anything the
+	// deduper already had was written before, possibly by another instance.
+	hashes := c.hashRecords()
+	inserted, err := c.deduper.InsertIfNew(hashes)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	c.writeRecords(not_included)
+	batch := make([]outputRecord, len(inserted))
+	for i, idx := range inserted {
+		batch[i] = c.records[idx]
+		batch[i].hashes = hashes[idx]
+	}
+	if err := c.sink.Write(batch); err != nil {
+		log.Fatal(err)
+	}
 }
 
-func (c *logEntryWriter) WriteEntry(entry *ct.LogEntry) {
-	if c.db == nil {
+func (c *logEntryWriter) WriteEntry(logName string, entry *ct.LogEntry) {
+	if c.deduper == nil {
 		log.Fatal("Must open logEntryWriter (logEntryWriter.Open()) before adding records")
 	}
 
@@ -269,30 +151,28 @@ func (c *logEntryWriter) WriteEntry(entry *ct.LogEntry) {
 	}
 
 	c.seenInBatch[sha256Fingerprint] = struct{}{}
-	c.ctRecords = append(c.ctRecords, entry)
-	if len(c.ctRecords) == DB_INSERT_THRESHOLD || time.Now().After(c.lastWriteTime.Add(WRITER_TIMER_TIME)) {
+	c.records = append(c.records, outputRecord{logName: logName, entry: entry})
+	if len(c.records) == DB_INSERT_THRESHOLD || time.Now().After(c.lastWriteTime.Add(WRITER_TIMER_TIME)) {
 		// insert records
-		c.insertAndWriteRecords()
-		c.ctRecords = make([]*ct.LogEntry, 0)
-		c.lastWriteTime = time.Now()
-		c.seenInBatch = make(map[string]struct{})
+		c.flushBatch()
 	}
 }
 
-func pushToFile(incoming <-chan *ct.LogEntry, wg *sync.WaitGroup, outputDirectory string) {
+// pushToSinks writes the incoming certificates to sink and forwards each
+// checkpoint to progress once the entries before it are durable.
+func pushToSinks(incoming <-chan outputItem, progress chan<- CTLogInfo, wg *sync.WaitGroup, sink OutputSink, deduper Deduper) {
 	defer wg.Done()
 
-	if _, err := ioutil.ReadDir(outputDirectory); err != nil {
-		log.Fatal(err)
-	}
-
-	writer := &logEntryWriter{
-		outputDir: outputDirectory,
-	}
-	writer.Open()
+	writer := &logEntryWriter{}
+	writer.Open(deduper, sink)
 	defer writer.Close()
 
-	for entry := range incoming {
-		writer.WriteEntry(entry)
+	for item := range incoming {
+		if item.checkpoint != nil {
+			writer.Checkpoint()
+			progress <- *item.checkpoint
+			continue
+		}
+		writer.WriteEntry(item.logName, item.entry)
 	}
 }
@@ -0,0 +1,103 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/teamnsrg/zcrypto/ct"
+	"github.com/teamnsrg/zcrypto/x509"
+)
+
+func testLogEntry(i int) *ct.LogEntry {
+	entry := &ct.LogEntry{Index: int64(i)}
+	entry.Leaf.TimestampedEntry.EntryType = ct.X509LogEntryType
+	entry.Leaf.TimestampedEntry.Timestamp = uint64(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Unix() * 1000)
+	entry.X509Cert = &x509.Certificate{
+		Raw:               []byte{byte(i)},
+		FingerprintSHA256: testHashBytes(i),
+		FingerprintNoCT:   testHashBytes(i + 1<<20),
+	}
+	return entry
+}
+
+// notCommitted is the committedFunc of a deduper that committed nothing.
+func notCommitted(checkpoint string) (bool, error) {
+	return false, nil
+}
+
+func readCSVRows(t *testing.T, dir string) int {
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := csv.NewReader(f).ReadAll()
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		count += len(rows)
+	}
+	return count
+}
+
+func TestPushToSinksCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctsync-output-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink, err := newCSVSink(SinkConfig{Type: kCSVSink, Dir: dir}, notCommitted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	incoming := make(chan outputItem)
+	progress := make(chan CTLogInfo)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go pushToSinks(incoming, progress, &wg, sink, newMemoryDeduper())
+
+	for i := 0; i < 5; i++ {
+		incoming <- outputItem{entry: testLogEntry(i)}
+	}
+	// A duplicate is written only once.
+	incoming <- outputItem{entry: testLogEntry(0)}
+	incoming <- newCheckpoint(CTLogInfo{Name: "test", LastIndex: 6})
+
+	l := <-progress
+	if l.Name != "test" || l.LastIndex != 6 {
+		t.Errorf("unexpected checkpoint %+v", l)
+	}
+	// The entries before the checkpoint are on disk before it is forwarded.
+	if rows := readCSVRows(t, dir); rows != 5 {
+		t.Errorf("expected 5 rows on disk at checkpoint, got %d", rows)
+	}
+
+	close(incoming)
+	wg.Wait()
+}
@@ -0,0 +1,513 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/teamnsrg/zcrypto/ct"
+)
+
+// kOpenSuffix marks a segment that is still being written. Renaming it away
+// seals the segment.
+const kOpenSuffix = ".open"
+
+// partitionOptions turn the output into numbered, sealed segments. With the
+// zero value a partition is one file that is appended to across runs.
+type partitionOptions struct {
+	// compression is "", kGzip or kZstd.
+	compression string
+	// maxSegmentBytes and maxSegmentAge roll a segment over when it grows
+	// past either; zero means no limit.
+	maxSegmentBytes int64
+	maxSegmentAge   time.Duration
+}
+
+// segmented reports whether partitions are written as segments. A
+// compressed stream cannot be appended to after a restart, so compression
+// always is.
+func (o partitionOptions) segmented() bool {
+	return o.compression != "" || o.maxSegmentBytes > 0 || o.maxSegmentAge > 0
+}
+
+// partFile is one open output file.
+type partFile struct {
+	// path is the final name; a segment is written to path+kOpenSuffix.
+	path   string
+	osFile *countingFile
+	buffer *bufio.Writer
+	// compressor, if set, writes to buffer.
+	compressor compressor
+	writer     io.Writer
+	opened     time.Time
+	// suspended is set while the file is closed to free its descriptor.
+	suspended bool
+}
+
+func (f *partFile) size() int64 {
+	return f.osFile.written + int64(f.buffer.Buffered())
+}
+
+// openPartFile opens name, where the file with final name path is written.
+func openPartFile(path, name string, flag int, compression string) (*partFile, error) {
+	osFile, err := os.OpenFile(name, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := osFile.Stat()
+	if err != nil {
+		osFile.Close()
+		return nil, err
+	}
+	file := &partFile{path: path, osFile: &countingFile{File: osFile, written: info.Size()}, opened: time.Now()}
+	file.buffer = bufio.NewWriter(file.osFile)
+	file.writer = file.buffer
+	if compression != "" {
+		if file.compressor, err = newCompressor(compression, file.buffer); err != nil {
+			osFile.Close()
+			return nil, err
+		}
+		file.writer = file.compressor
+	}
+	return file, nil
+}
+
+// suspend closes f without sealing it or making it durable. A compressed
+// stream is ended, and resume starts another one in the same file; readers
+// take the concatenated streams as one.
+func (f *partFile) suspend() error {
+	if f.compressor != nil {
+		if err := f.compressor.Close(); err != nil {
+			f.osFile.Close()
+			return fmt.Errorf("unable to compress %s: %s", f.path, err)
+		}
+		f.compressor = nil
+	}
+	if err := f.buffer.Flush(); err != nil {
+		f.osFile.Close()
+		return fmt.Errorf("unable to write %s: %s", f.path, err)
+	}
+	f.suspended = true
+	return f.osFile.Close()
+}
+
+// resume reopens a suspended file to append to it.
+func (f *partFile) resume(compression string) error {
+	file, err := openPartFile(f.path, f.osFile.Name(), os.O_APPEND|os.O_WRONLY, compression)
+	if err != nil {
+		return err
+	}
+	file.opened = f.opened
+	*f = *file
+	return nil
+}
+
+// flush makes everything written to f durable.
+func (f *partFile) flush() error {
+	if f.suspended {
+		return syncFile(f.osFile.Name())
+	}
+	if f.compressor != nil {
+		if err := f.compressor.Flush(); err != nil {
+			return fmt.Errorf("unable to compress %s: %s", f.path, err)
+		}
+	}
+	if err := f.buffer.Flush(); err != nil {
+		return fmt.Errorf("unable to write %s: %s", f.path, err)
+	}
+	if err := f.osFile.Sync(); err != nil {
+		return fmt.Errorf("unable to sync %s: %s", f.path, err)
+	}
+	return nil
+}
+
+// close ends the compressed stream, makes the file durable and closes it.
+func (f *partFile) close() error {
+	if f.suspended {
+		return f.flush()
+	}
+	if f.compressor != nil {
+		if err := f.compressor.Close(); err != nil {
+			f.osFile.Close()
+			return fmt.Errorf("unable to compress %s: %s", f.path, err)
+		}
+		f.compressor = nil
+	}
+	err := f.flush()
+	if closeErr := f.osFile.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// partitionedFiles are the files of a sink, laid out as
+// dir/<year logged>/<first three hex digits of the certificate hash><ext>,
+// or, when segmented, as numbered segments <prefix>-000001<ext>.gz and so on.
+type partitionedFiles struct {
+	dir         string
+	ext         string
+	opts        partitionOptions
+	checkpoints *checkpointLog
+	files       map[string]*partFile
+	// dirty holds the files written since the last Flush.
+	dirty map[*partFile]struct{}
+	// sealed are the segments closed since the last Flush. They get their
+	// final names once the checkpoint covering them is committed.
+	sealed []*partFile
+	// nextSegment is the number of the next segment of each partition, for
+	// the years whose directory was scanned.
+	nextSegment  map[string]int
+	scannedYears map[string]bool
+}
+
+// newPartitionedFiles cuts files back to their size at the last committed
+// checkpoint, removes those created since, and seals the segments a crash
+// left open.
+func newPartitionedFiles(dir, ext string, opts partitionOptions, committed committedFunc) (*partitionedFiles, error) {
+	if _, err := compressionExt(opts.compression); err != nil {
+		return nil, err
+	}
+	checkpointSizes, logged, err := readCheckpointLog(dir, committed)
+	if err != nil {
+		return nil, err
+	}
+	p := &partitionedFiles{
+		dir:          dir,
+		ext:          ext,
+		opts:         opts,
+		files:        make(map[string]*partFile),
+		dirty:        make(map[*partFile]struct{}),
+		nextSegment:  make(map[string]int),
+		scannedYears: make(map[string]bool),
+	}
+	sizes := make(map[string]int64)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == dir {
+			return nil
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		name := info.Name()
+		open := strings.HasSuffix(name, kOpenSuffix) && strings.Contains(name, ext)
+		if _, _, segment := segmentNumber(name); !open && (segment || !strings.HasSuffix(name, ext)) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		size, known := checkpointSizes[rel]
+		switch {
+		case !logged:
+			size = info.Size()
+		case !known:
+			log.Warnf("removing %s, which was created after the last checkpoint", path)
+			return os.Remove(path)
+		case size < info.Size():
+			log.Warnf("cutting %s back to %d bytes written before the last checkpoint", path, size)
+			if err := os.Truncate(path, size); err != nil {
+				return err
+			}
+		}
+		if open {
+			return recoverSegment(path)
+		}
+		sizes[rel] = size
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p.checkpoints, err = newCheckpointLog(dir, sizes); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ctLoggedYear is the year the entry was logged, which the output is
+// partitioned by.
+func ctLoggedYear(entry *ct.LogEntry) string {
+	ctTimestamp := time.Unix(int64(entry.Leaf.TimestampedEntry.Timestamp/1000), 0)
+	return strconv.Itoa(ctTimestamp.Year())
+}
+
+// segmentNumber parses the number of a segment file name such as
+// "abc-000012.csv.gz".
+func segmentNumber(name string) (prefix string, n int, ok bool) {
+	name = strings.SplitN(name, ".", 2)[0]
+	dash := strings.LastIndex(name, "-")
+	if dash < 0 {
+		return "", 0, false
+	}
+	n, err := strconv.Atoi(name[dash+1:])
+	return name[:dash], n, err == nil
+}
+
+// next returns the number of the next segment of year and hashPrefix. The
+// numbers continue after the segments of earlier runs.
+func (p *partitionedFiles) next(year, hashPrefix string) (int, error) {
+	if !p.scannedYears[year] {
+		names, err := ioutil.ReadDir(filepath.Join(p.dir, year))
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		for _, info := range names {
+			if prefix, n, ok := segmentNumber(info.Name()); ok {
+				key := filepath.Join(year, prefix)
+				if n >= p.nextSegment[key] {
+					p.nextSegment[key] = n + 1
+				}
+			}
+		}
+		p.scannedYears[year] = true
+	}
+	key := filepath.Join(year, hashPrefix)
+	n := p.nextSegment[key]
+	if n < 1 {
+		n = 1
+	}
+	p.nextSegment[key] = n + 1
+	return n, nil
+}
+
+func (p *partitionedFiles) open(year, hashPrefix string) (*partFile, error) {
+	if err := os.MkdirAll(filepath.Join(p.dir, year), 0755); err != nil {
+		return nil, err
+	}
+	if !p.opts.segmented() {
+		path := filepath.Join(p.dir, year, hashPrefix+p.ext)
+		return openPartFile(path, path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, "")
+	}
+	n, err := p.next(year, hashPrefix)
+	if err != nil {
+		return nil, err
+	}
+	compressedExt, _ := compressionExt(p.opts.compression)
+	path := filepath.Join(p.dir, year, fmt.Sprintf("%s-%06d%s%s", hashPrefix, n, p.ext, compressedExt))
+	return openPartFile(path, path+kOpenSuffix, os.O_CREATE|os.O_EXCL|os.O_WRONLY, p.opts.compression)
+}
+
+// due reports whether file should be rolled over. Size counts the bytes that
+// reached the file, so a compressed segment may overshoot by what its
+// compressor buffers until the next Flush.
+func (p *partitionedFiles) due(file *partFile, now time.Time) bool {
+	if !p.opts.segmented() {
+		return false
+	}
+	return p.opts.maxSegmentBytes > 0 && file.size() >= p.opts.maxSegmentBytes ||
+		p.opts.maxSegmentAge > 0 && now.Sub(file.opened) >= p.opts.maxSegmentAge
+}
+
+// seal finishes the file of key. A segment is renamed to its final name
+// once the next checkpoint is committed.
+func (p *partitionedFiles) seal(key string) error {
+	file := p.files[key]
+	delete(p.files, key)
+	delete(p.dirty, file)
+	openFiles.remove(openFileKey{owner: p, key: key})
+	if err := file.close(); err != nil {
+		return err
+	}
+	if p.opts.segmented() {
+		p.sealed = append(p.sealed, file)
+	}
+	return nil
+}
+
+// rename gives the sealed segments their final names.
+func (p *partitionedFiles) rename() error {
+	for len(p.sealed) > 0 {
+		file := p.sealed[0]
+		if err := os.Rename(file.path+kOpenSuffix, file.path); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(p.dir, file.path+kOpenSuffix)
+		if err != nil {
+			return err
+		}
+		p.checkpoints.forget(rel)
+		p.sealed = p.sealed[1:]
+	}
+	return nil
+}
+
+// writer returns the file for year and hashPrefix, opening it or the next
+// segment if needed. Files evicted from openFiles are suspended, and
+// reopened here when they are written again.
+func (p *partitionedFiles) writer(year, hashPrefix string) (io.Writer, error) {
+	key := filepath.Join(year, hashPrefix)
+	file, ok := p.files[key]
+	if ok && p.due(file, time.Now()) {
+		if err := p.seal(key); err != nil {
+			return nil, err
+		}
+		ok = false
+	}
+	id := openFileKey{owner: p, key: key}
+	if err := openFiles.touch(id, func() error { return p.files[key].suspend() }); err != nil {
+		return nil, err
+	}
+	if !ok {
+		var err error
+		if file, err = p.open(year, hashPrefix); err != nil {
+			openFiles.remove(id)
+			return nil, err
+		}
+		p.files[key] = file
+	} else if file.suspended {
+		if err := file.resume(p.opts.compression); err != nil {
+			openFiles.remove(id)
+			return nil, err
+		}
+	}
+	p.dirty[file] = struct{}{}
+	return file.writer, nil
+}
+
+// Flush seals the segments that are due, makes every file written since the
+// last Flush durable, suspended ones included, and records their sizes as of
+// checkpoint.
+func (p *partitionedFiles) Flush(checkpoint string) error {
+	now := time.Now()
+	for key, file := range p.files {
+		if p.due(file, now) {
+			if err := p.seal(key); err != nil {
+				return err
+			}
+		}
+	}
+	sizes := make(map[string]int64)
+	for file := range p.dirty {
+		if err := file.flush(); err != nil {
+			return err
+		}
+		delete(p.dirty, file)
+		if err := p.record(sizes, file); err != nil {
+			return err
+		}
+	}
+	for _, file := range p.sealed {
+		if err := p.record(sizes, file); err != nil {
+			return err
+		}
+	}
+	return p.checkpoints.prepare(checkpoint, sizes)
+}
+
+func (p *partitionedFiles) record(sizes map[string]int64, file *partFile) error {
+	rel, err := filepath.Rel(p.dir, file.osFile.Name())
+	if err != nil {
+		return err
+	}
+	sizes[rel] = file.size()
+	return nil
+}
+
+// Committed is called once the checkpoint of the last Flush is committed.
+func (p *partitionedFiles) Committed() error {
+	if err := p.checkpoints.commit(); err != nil {
+		return err
+	}
+	return p.rename()
+}
+
+// Close seals every open file. It is called after the last checkpoint was
+// committed, so segments get their final names right away.
+func (p *partitionedFiles) Close() error {
+	var first error
+	for key := range p.files {
+		if err := p.seal(key); err != nil && first == nil {
+			first = err
+		}
+	}
+	if err := p.rename(); err != nil && first == nil {
+		first = err
+	}
+	if err := p.checkpoints.Close(); err != nil && first == nil {
+		first = err
+	}
+	return first
+}
+
+// recoverSegment seals a segment left open by a crash, once it was cut back
+// to the last committed checkpoint. It keeps the complete lines that can
+// still be decoded. Without a checkpoint log, as after an upgrade, a line cut
+// off mid-write belongs to a certificate whose dedup insert was never
+// committed, so it is written again.
+func recoverSegment(openPath string) error {
+	path := strings.TrimSuffix(openPath, kOpenSuffix)
+	compression := compressionOf(path)
+	in, err := os.Open(openPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	decompressed, err := newDecompressor(compression, in)
+	if err != nil {
+		log.Warnf("%s: %s; sealing it empty", openPath, err)
+		decompressed = ioutil.NopCloser(strings.NewReader(""))
+	}
+	defer decompressed.Close()
+
+	tmpPath := path + ".recover"
+	file, err := openPartFile(path, tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, compression)
+	if err != nil {
+		return err
+	}
+	lines := 0
+	reader := bufio.NewReader(decompressed)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		if _, err := file.writer.Write(line); err != nil {
+			file.close()
+			return err
+		}
+		lines++
+	}
+	if err := file.close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	log.Warnf("sealed %s left open by a crash, keeping %d lines", path, lines)
+	return os.Remove(openPath)
+}
+
+// syncFile makes a file that was closed without an fsync durable.
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to sync %s: %s", path, err)
+	}
+	return f.Close()
+}
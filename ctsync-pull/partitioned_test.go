@@ -0,0 +1,216 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func readSegment(t *testing.T, path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := newDecompressor(compressionOf(path), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("%s: %s", path, err)
+	}
+	return string(contents)
+}
+
+func writeLines(t *testing.T, p *partitionedFiles, from, to int) {
+	for i := from; i < to; i++ {
+		w, err := p.writer("2024", "abc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(w, "line %d\n", i)
+	}
+}
+
+func TestPartitionedFilesSegments(t *testing.T) {
+	for _, compression := range []string{kGzip, kZstd} {
+		dir, err := ioutil.TempDir("", "ctsync-partitioned-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		opts := partitionOptions{compression: compression, maxSegmentBytes: 1}
+
+		p, err := newPartitionedFiles(dir, ".csv", opts, notCommitted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ext, _ := compressionExt(compression)
+		// Compressors buffer, so how full a segment is shows after a Flush.
+		for i := 0; i < 2; i++ {
+			before, _ := filepath.Glob(filepath.Join(dir, "2024", "*.csv"+ext))
+			writeLines(t, p, i, i+1)
+			if err := p.Flush("test"); err != nil {
+				t.Fatal(err)
+			}
+			// Segments keep their open name until the checkpoint is committed.
+			if sealed, _ := filepath.Glob(filepath.Join(dir, "2024", "*.csv"+ext)); len(sealed) != len(before) {
+				t.Fatalf("%s: sealed %v before the checkpoint was committed", compression, sealed)
+			}
+			if err := p.Committed(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sealed, _ := filepath.Glob(filepath.Join(dir, "2024", "*.csv.*"))
+		if len(sealed) != 2 {
+			t.Fatalf("%s: sealed %v after Flush", compression, sealed)
+		}
+		writeLines(t, p, 2, 3)
+		if err := p.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// A later run continues the numbering.
+		p, err = newPartitionedFiles(dir, ".csv", opts, notCommitted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeLines(t, p, 3, 4)
+		if err := p.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		segments, _ := filepath.Glob(filepath.Join(dir, "2024", "*"))
+		sort.Strings(segments)
+		var want []string
+		for i := 1; i <= 4; i++ {
+			want = append(want, filepath.Join(dir, "2024", fmt.Sprintf("abc-%06d.csv%s", i, ext)))
+		}
+		if fmt.Sprint(segments) != fmt.Sprint(want) {
+			t.Fatalf("%s: segments %v, want %v", compression, segments, want)
+		}
+		contents := ""
+		for _, segment := range segments {
+			contents += readSegment(t, segment)
+		}
+		if contents != "line 0\nline 1\nline 2\nline 3\n" {
+			t.Errorf("%s: read back %q", compression, contents)
+		}
+	}
+}
+
+func TestPartitionedFilesRecover(t *testing.T) {
+	for _, compression := range []string{"", kGzip, kZstd} {
+		dir, err := ioutil.TempDir("", "ctsync-partitioned-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		opts := partitionOptions{compression: compression, maxSegmentAge: 1 << 40}
+		committed := func(checkpoint string) (bool, error) {
+			return checkpoint == "test", nil
+		}
+
+		p, err := newPartitionedFiles(dir, ".jsonl", opts, committed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeLines(t, p, 0, 2)
+		if err := p.Flush("test"); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Committed(); err != nil {
+			t.Fatal(err)
+		}
+		// Simulate a crash after the checkpoint, partway through a line: the
+		// segment stays open and is cut back to the checkpoint.
+		writeLines(t, p, 2, 3)
+		w, _ := p.writer("2024", "abc")
+		w.Write([]byte("line 3 is cut"))
+		file := p.files[filepath.Join("2024", "abc")]
+		file.flush()
+		file.osFile.Close()
+
+		if _, err := newPartitionedFiles(dir, ".jsonl", opts, committed); err != nil {
+			t.Fatal(err)
+		}
+		ext, _ := compressionExt(compression)
+		path := filepath.Join(dir, "2024", "abc-000001.jsonl"+ext)
+		if _, err := os.Stat(path + kOpenSuffix); !os.IsNotExist(err) {
+			t.Errorf("%s: open segment was kept: %v", compression, err)
+		}
+		if contents := readSegment(t, path); contents != "line 0\nline 1\n" {
+			t.Errorf("%s: recovered %q", compression, contents)
+		}
+	}
+}
+
+func TestPartitionedFilesCheckpoint(t *testing.T) {
+	for _, lastCommitted := range []string{"one", "two"} {
+		dir, err := ioutil.TempDir("", "ctsync-partitioned-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		committed := func(checkpoint string) (bool, error) {
+			return checkpoint == lastCommitted, nil
+		}
+
+		p, err := newPartitionedFiles(dir, ".csv", partitionOptions{}, committed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeLines(t, p, 0, 2)
+		if err := p.Flush("one"); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Committed(); err != nil {
+			t.Fatal(err)
+		}
+		writeLines(t, p, 2, 3)
+		if err := p.Flush("two"); err != nil {
+			t.Fatal(err)
+		}
+		// Simulate a crash after more was written.
+		writeLines(t, p, 3, 4)
+		w, _ := p.writer("2024", "def")
+		w.Write([]byte("new file\n"))
+		for _, file := range p.files {
+			file.buffer.Flush()
+			file.osFile.Close()
+		}
+
+		if _, err := newPartitionedFiles(dir, ".csv", partitionOptions{}, committed); err != nil {
+			t.Fatal(err)
+		}
+		want := "line 0\nline 1\n"
+		if lastCommitted == "two" {
+			want += "line 2\n"
+		}
+		if contents := readSegment(t, filepath.Join(dir, "2024", "abc.csv")); contents != want {
+			t.Errorf("%s committed: kept %q", lastCommitted, contents)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "2024", "def.csv")); !os.IsNotExist(err) {
+			t.Errorf("%s committed: file created after the checkpoint was kept: %v", lastCommitted, err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// PostgresConfig describes the Postgres server holding downloaded_certs. It
+// is read from the -postgres-config file; -postgres-dsn overrides DSN. Any
+// setting left empty falls back to lib/pq's PGHOST, PGPORT, PGUSER,
+// PGPASSWORD, PGPASSFILE, PGSSLMODE, ... environment variables.
+type PostgresConfig struct {
+	// DSN is a complete connection string, either key=value pairs or a
+	// postgres:// URL. The individual fields below are added to it when it
+	// is in key=value form.
+	DSN         string `json:"dsn"`
+	Host        string `json:"host"`
+	Port        int    `json:"port"`
+	User        string `json:"user"`
+	DBName      string `json:"dbname"`
+	SSLMode     string `json:"sslmode"`
+	SSLRootCert string `json:"sslrootcert"`
+	SSLCert     string `json:"sslcert"`
+	SSLKey      string `json:"sslkey"`
+	// PasswordFile holds just the password, e.g. a mounted secret.
+	PasswordFile string `json:"password_file"`
+
+	MaxOpenConns    int    `json:"max_open_conns"`
+	MaxIdleConns    int    `json:"max_idle_conns"`
+	ConnMaxLifetime string `json:"conn_max_lifetime"`
+}
+
+func readPostgresConfig(filepath string) (PostgresConfig, error) {
+	var config PostgresConfig
+	contents, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(contents, &config)
+	return config, err
+}
+
+// legacyPostgresDSN is the local socket connection ctsync-pull has always used
+// when nothing else is configured.
+func legacyPostgresDSN() string {
+	if runtime.GOOS == "linux" {
+		return "user=ctdownloader dbname=ctdownload sslmode=disable host=/var/run/postgresql"
+	}
+	return "user=ctdownloader dbname=ctdownload sslmode=disable"
+}
+
+// kPostgresEnvironment are the libpq variables lib/pq reads to decide where
+// and how to connect.
+var kPostgresEnvironment = []string{
+	"PGHOST", "PGHOSTADDR", "PGPORT", "PGDATABASE", "PGUSER", "PGPASSWORD",
+	"PGPASSFILE", "PGSERVICE", "PGSERVICEFILE", "PGSSLMODE", "PGSSLCERT",
+	"PGSSLKEY", "PGSSLROOTCERT", "PGREQUIRESSL", "PGCONNECT_TIMEOUT",
+	"PGOPTIONS", "PGAPPNAME",
+}
+
+func hasPostgresEnvironment() bool {
+	for _, name := range kPostgresEnvironment {
+		if os.Getenv(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// quoteDSNValue quotes a value for a key=value connection string.
+func quoteDSNValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `'`, `\'`, -1)
+	return "'" + value + "'"
+}
+
+func (c PostgresConfig) connectionString() (string, error) {
+	params := []string{}
+	add := func(key, value string) {
+		if value != "" {
+			params = append(params, key+"="+quoteDSNValue(value))
+		}
+	}
+	add("host", c.Host)
+	if c.Port != 0 {
+		add("port", fmt.Sprint(c.Port))
+	}
+	add("user", c.User)
+	add("dbname", c.DBName)
+	add("sslmode", c.SSLMode)
+	add("sslrootcert", c.SSLRootCert)
+	add("sslcert", c.SSLCert)
+	add("sslkey", c.SSLKey)
+	if c.PasswordFile != "" {
+		password, err := ioutil.ReadFile(c.PasswordFile)
+		if err != nil {
+			return "", err
+		}
+		add("password", strings.TrimRight(string(password), "\r\n"))
+	}
+
+	if strings.HasPrefix(c.DSN, "postgres://") || strings.HasPrefix(c.DSN, "postgresql://") {
+		if len(params) > 0 {
+			return "", errors.New("postgres URL DSN cannot be combined with other postgres settings")
+		}
+		return c.DSN, nil
+	}
+	if c.DSN == "" && len(params) == 0 && !hasPostgresEnvironment() {
+		return legacyPostgresDSN(), nil
+	}
+	if c.DSN != "" {
+		params = append([]string{c.DSN}, params...)
+	}
+	return strings.Join(params, " "), nil
+}
+
+func openPostgres(c PostgresConfig) (*sql.DB, error) {
+	dsn, err := c.connectionString()
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if c.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(c.MaxOpenConns)
+	}
+	if c.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(c.MaxIdleConns)
+	}
+	if c.ConnMaxLifetime != "" {
+		lifetime, err := time.ParseDuration(c.ConnMaxLifetime)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("invalid conn_max_lifetime: %s", err)
+		}
+		db.SetConnMaxLifetime(lifetime)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
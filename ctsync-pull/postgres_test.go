@@ -0,0 +1,71 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestPostgresConnectionString(t *testing.T) {
+	passwordFile, err := ioutil.TempFile("", "ctsync-pg-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwordFile.Name())
+	passwordFile.WriteString("it's secret\n")
+	passwordFile.Close()
+
+	config := PostgresConfig{
+		DSN:          "application_name=ctsync",
+		Host:         "db.example.com",
+		Port:         5433,
+		SSLMode:      "verify-full",
+		PasswordFile: passwordFile.Name(),
+	}
+	dsn, err := config.connectionString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `application_name=ctsync host='db.example.com' port='5433' sslmode='verify-full' password='it\'s secret'`
+	if dsn != expected {
+		t.Errorf("expected %s, got %s", expected, dsn)
+	}
+
+	config = PostgresConfig{DSN: "postgres://ctdownloader@db.example.com/ctdownload", Host: "other"}
+	if _, err := config.connectionString(); err == nil {
+		t.Error("URL DSN combined with host accepted")
+	}
+}
+
+func TestHasPostgresEnvironment(t *testing.T) {
+	for _, name := range kPostgresEnvironment {
+		if value, ok := os.LookupEnv(name); ok {
+			defer os.Setenv(name, value)
+			os.Unsetenv(name)
+		}
+	}
+	os.Setenv("PGX_UNRELATED", "1")
+	defer os.Unsetenv("PGX_UNRELATED")
+	if hasPostgresEnvironment() {
+		t.Error("unrelated PG variable taken as libpq configuration")
+	}
+	os.Setenv("PGHOST", "db.example.com")
+	defer os.Unsetenv("PGHOST")
+	if !hasPostgresEnvironment() {
+		t.Error("PGHOST ignored")
+	}
+}
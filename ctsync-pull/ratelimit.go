@@ -0,0 +1,268 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// kRateLimitPause is how long a log is left alone after a 429 or 503
+	// without a Retry-After header.
+	kRateLimitPause = 10 * time.Second
+	// kMaxRetryAfter bounds the pause a log can ask for.
+	kMaxRetryAfter = time.Hour
+)
+
+// requestLimiter spaces requests to stay under a rate and caps how many are
+// in flight. The zero rate and concurrency mean no limit.
+type requestLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	// next is the earliest time the next request may start.
+	next  time.Time
+	slots chan struct{}
+}
+
+func newRequestLimiter(requestsPerSecond float64, concurrent int) *requestLimiter {
+	r := &requestLimiter{}
+	if requestsPerSecond > 0 {
+		r.interval = time.Duration(float64(time.Second) / requestsPerSecond)
+	}
+	if concurrent > 0 {
+		r.slots = make(chan struct{}, concurrent)
+	}
+	return r
+}
+
+// acquire waits for a free slot and for the request's turn.
+func (r *requestLimiter) acquire(ctx context.Context) error {
+	if r.slots != nil {
+		select {
+		case r.slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	r.mu.Lock()
+	now := time.Now()
+	start := r.next
+	if start.Before(now) {
+		start = now
+	}
+	r.next = start.Add(r.interval)
+	r.mu.Unlock()
+	if wait := start.Sub(now); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			r.release()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (r *requestLimiter) release() {
+	if r.slots != nil {
+		<-r.slots
+	}
+}
+
+// pause holds back every request until t.
+func (r *requestLimiter) pause(t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t.After(r.next) {
+		r.next = t
+	}
+}
+
+// rateLimits holds the limiters for every log and operator. Requests are
+// matched to a log by the longest registered URL prefix.
+type rateLimits struct {
+	mu        sync.RWMutex
+	global    *requestLimiter
+	operators map[string]*requestLimiter
+	prefixes  map[string][]*requestLimiter
+}
+
+// rateLimitOptions are the global limits and the default per-log limits;
+// zero means unlimited.
+type rateLimitOptions struct {
+	globalRPS         float64
+	globalConcurrency int
+	logRPS            float64
+	logConcurrency    int
+}
+
+var requestLimits = newRateLimits()
+
+// newRateLimits starts out without any limits.
+func newRateLimits() *rateLimits {
+	return &rateLimits{
+		global:    newRequestLimiter(0, 0),
+		operators: make(map[string]*requestLimiter),
+		prefixes:  make(map[string][]*requestLimiter),
+	}
+}
+
+// configure sets up a limiter for each log, one shared by the logs of each
+// operator, and the global limiter.
+func (r *rateLimits) configure(configuration Configuration, operators map[string]*OperatorInfo, opts rateLimitOptions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.global = newRequestLimiter(opts.globalRPS, opts.globalConcurrency)
+	r.operators = make(map[string]*requestLimiter)
+	for name, operator := range operators {
+		r.operators[name] = newRequestLimiter(operator.RequestsPerSecond, operator.MaxConcurrentRequests)
+	}
+	r.prefixes = make(map[string][]*requestLimiter)
+	for _, l := range configuration {
+		rps, concurrency := opts.logRPS, opts.logConcurrency
+		if l.RequestsPerSecond > 0 {
+			rps = l.RequestsPerSecond
+		}
+		if l.MaxConcurrentRequests > 0 {
+			concurrency = l.MaxConcurrentRequests
+		}
+		chain := []*requestLimiter{newRequestLimiter(rps, concurrency)}
+		if operator, ok := r.operators[l.Operator]; ok {
+			chain = append(chain, operator)
+		}
+		chain = append(chain, r.global)
+		r.prefixes[l.BaseURL] = chain
+		if l.API == kStaticAPI {
+			r.prefixes[l.monitoringPrefix()] = chain
+		}
+	}
+}
+
+// limitersFor returns the limiters of the log serving url, most specific
+// first.
+func (r *rateLimits) limitersFor(url string) []*requestLimiter {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	match := ""
+	for prefix := range r.prefixes {
+		if strings.HasPrefix(url, prefix) && len(prefix) > len(match) {
+			match = prefix
+		}
+	}
+	if match == "" {
+		return []*requestLimiter{r.global}
+	}
+	return r.prefixes[match]
+}
+
+// retryAfter parses a Retry-After header, either in seconds or as a date.
+func retryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(strings.TrimSpace(header)); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return t.Sub(now), true
+	}
+	return 0, false
+}
+
+// limitedTransport makes every request to a log wait for that log's limiters,
+// and pauses the log and its operator when asked to back off. The timeout
+// covers the request itself, not the wait.
+type limitedTransport struct {
+	base      http.RoundTripper
+	limits    *rateLimits
+	timeout   time.Duration
+	userAgent string
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	url := req.URL.String()
+	limiters := t.limits.limitersFor(url)
+	acquired := 0
+	release := func() {
+		for _, limiter := range limiters[:acquired] {
+			limiter.release()
+		}
+	}
+	for _, limiter := range limiters {
+		if err := limiter.acquire(req.Context()); err != nil {
+			release()
+			return nil, err
+		}
+		acquired++
+	}
+
+	ctx, cancel := req.Context(), context.CancelFunc(func() {})
+	if t.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+	}
+	req = req.Clone(ctx)
+	if t.userAgent != "" {
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		cancel()
+		release()
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		delay, ok := retryAfter(resp.Header.Get("Retry-After"), time.Now())
+		if !ok {
+			delay = jitter(kRateLimitPause)
+		}
+		if delay > kMaxRetryAfter {
+			delay = kMaxRetryAfter
+		}
+		log.Warnf("%s: %s, pausing requests for %s", url, resp.Status, delay)
+		until := time.Now().Add(delay)
+		// Every limiter but the global one belongs to this log's operator.
+		for _, limiter := range limiters {
+			if limiter != t.limits.global || len(limiters) == 1 {
+				limiter.pause(until)
+			}
+		}
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() {
+		cancel()
+		release()
+	}}
+	return resp, nil
+}
+
+// releasingBody gives back the request's slots once the body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
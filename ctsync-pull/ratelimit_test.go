@@ -0,0 +1,110 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if d, ok := retryAfter("120", now); !ok || d != 2*time.Minute {
+		t.Errorf("seconds: got %s %t", d, ok)
+	}
+	if d, ok := retryAfter("Mon, 01 Jan 2024 00:00:30 GMT", now); !ok || d != 30*time.Second {
+		t.Errorf("date: got %s %t", d, ok)
+	}
+	if _, ok := retryAfter("soon", now); ok {
+		t.Error("accepted a malformed header")
+	}
+}
+
+func TestRequestLimiterRate(t *testing.T) {
+	r := newRequestLimiter(100, 0)
+	began := time.Now()
+	for i := 0; i < 11; i++ {
+		if err := r.acquire(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		r.release()
+	}
+	if elapsed := time.Since(began); elapsed < 100*time.Millisecond {
+		t.Errorf("11 requests at 100/s took only %s", elapsed)
+	}
+}
+
+func TestRequestLimiterConcurrency(t *testing.T) {
+	r := newRequestLimiter(0, 1)
+	if err := r.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := r.acquire(ctx); err == nil {
+		t.Fatal("acquired a second slot")
+	}
+	r.release()
+	if err := r.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLimitedTransportRetryAfter(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+	limits := newRateLimits()
+	config := Configuration{{Name: "a", BaseURL: server.URL + "/a", Operator: "op"}}
+	limits.configure(config, config.operators(OperatorInfo{}, nil), rateLimitOptions{})
+	client := &http.Client{Transport: &limitedTransport{base: http.DefaultTransport, limits: limits}}
+
+	resp, err := client.Get(server.URL + "/a/ct/v1/get-sth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("unexpected status %s", resp.Status)
+	}
+	// Other operators' logs are not held back.
+	began := time.Now()
+	resp, err = client.Get(server.URL + "/b/ct/v1/get-sth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(began); elapsed > 500*time.Millisecond {
+		t.Errorf("unrelated log waited %s", elapsed)
+	}
+	began = time.Now()
+	resp, err = client.Get(server.URL + "/a/ct/v1/get-sth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(began); elapsed < 500*time.Millisecond {
+		t.Errorf("log was asked again after only %s", elapsed)
+	}
+}
@@ -0,0 +1,254 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/teamnsrg/zcrypto/ct"
+)
+
+// outputRecord is a certificate seen for the first time, as handed to the
+// sinks.
+type outputRecord struct {
+	logName string
+	entry   *ct.LogEntry
+	hashes  *certHashes
+}
+
+// OutputSink is somewhere deduplicated certificates are written to.
+type OutputSink interface {
+	Write(batch []outputRecord) error
+	// Flush returns once everything written so far is durable, and recorded
+	// as of checkpoint. Progress is saved only after every sink flushed.
+	Flush(checkpoint string) error
+	// Committed is called once the dedup inserts of the last Flush are
+	// committed.
+	Committed() error
+	Close() error
+}
+
+// What a sink's failure does to the run.
+const (
+	// kSinkFatal stops ctsync-pull, so no progress is saved past entries the
+	// sink did not get. This is the default.
+	kSinkFatal = "fatal"
+	// kSinkDisable stops writing to the sink and carries on with the others.
+	kSinkDisable = "disable"
+	// kSinkLog logs the error and keeps writing to the sink; the failed
+	// batch is lost for it.
+	kSinkLog = "log"
+)
+
+const (
+	kCSVSink     = "csv"
+	kJSONLSink   = "jsonl"
+	kParquetSink = "parquet"
+)
+
+// SinkConfig is one entry of the -sinks file.
+type SinkConfig struct {
+	// Type is the output format, "csv", "jsonl" or "parquet".
+	Type string `json:"type"`
+	// Dir is where the sink writes its files.
+	Dir string `json:"dir"`
+	// OnError is kSinkFatal, kSinkDisable or kSinkLog.
+	OnError string `json:"on_error"`
+	// FullJSON adds zcrypto's JSON of each certificate to jsonl output.
+	FullJSON bool `json:"full_json"`
+	// PrefixLength is how many hex digits of the certificate hash partition
+	// parquet output.
+	PrefixLength int `json:"prefix_length"`
+	// RowGroupBytes and MaxFileBytes size parquet row groups and files,
+	// MaxBufferBytes caps the row groups buffered across all open parquet
+	// files, and MaxFileAge (a duration) bounds how long a parquet file
+	// stays open.
+	RowGroupBytes  int64  `json:"row_group_bytes"`
+	MaxBufferBytes int64  `json:"max_buffer_bytes"`
+	MaxFileBytes   int64  `json:"max_file_bytes"`
+	MaxFileAge     string `json:"max_file_age"`
+	// Compression is "gzip" or "zstd". Compressed csv and jsonl output is
+	// written in segments; parquet uses it as its column codec.
+	Compression string `json:"compression"`
+	// MaxSegmentBytes and MaxSegmentAge (a duration such as "1h") roll csv
+	// and jsonl output over into a new segment.
+	MaxSegmentBytes int64  `json:"max_segment_bytes"`
+	MaxSegmentAge   string `json:"max_segment_age"`
+}
+
+func (cfg SinkConfig) name() string {
+	return fmt.Sprintf("%s sink in %s", cfg.Type, cfg.Dir)
+}
+
+// readSinkConfig reads a JSON list of SinkConfig.
+func readSinkConfig(path string) ([]SinkConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var configs []SinkConfig
+	if err := json.NewDecoder(f).Decode(&configs); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return configs, nil
+}
+
+func (cfg SinkConfig) partitionOptions() (partitionOptions, error) {
+	opts := partitionOptions{compression: cfg.Compression, maxSegmentBytes: cfg.MaxSegmentBytes}
+	if cfg.MaxSegmentAge != "" {
+		age, err := time.ParseDuration(cfg.MaxSegmentAge)
+		if err != nil {
+			return opts, fmt.Errorf("%s: max_segment_age: %s", cfg.name(), err)
+		}
+		opts.maxSegmentAge = age
+	}
+	return opts, nil
+}
+
+// newSink opens the sink of cfg. committed decides what output written
+// before a crash is kept.
+func newSink(cfg SinkConfig, committed committedFunc) (OutputSink, error) {
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("%s sink has no dir", cfg.Type)
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+	switch cfg.Type {
+	case kCSVSink:
+		return newCSVSink(cfg, committed)
+	case kJSONLSink:
+		return newJSONLSink(cfg, committed)
+	case kParquetSink:
+		return newParquetSink(cfg, committed)
+	}
+	return nil, fmt.Errorf("unknown sink type %q", cfg.Type)
+}
+
+type fanOutTarget struct {
+	name     string
+	sink     OutputSink
+	onError  string
+	disabled bool
+}
+
+// fanOutSink writes every batch to several sinks, handling each sink's
+// errors by its policy. It fails only when a fatal sink does.
+type fanOutSink struct {
+	targets []*fanOutTarget
+}
+
+func newFanOutSink(configs []SinkConfig, committed committedFunc) (*fanOutSink, error) {
+	// Each sink recovers its files from the checkpoint log in its dir, so
+	// two sinks cannot share one.
+	dirs := make(map[string]string)
+	for _, cfg := range configs {
+		if cfg.Dir == "" {
+			continue
+		}
+		dir, err := filepath.Abs(cfg.Dir)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := dirs[dir]; ok {
+			return nil, fmt.Errorf("%s: dir is already used by the %s", cfg.name(), other)
+		}
+		dirs[dir] = cfg.name()
+	}
+	f := &fanOutSink{}
+	for _, cfg := range configs {
+		switch cfg.OnError {
+		case "":
+			cfg.OnError = kSinkFatal
+		case kSinkFatal, kSinkDisable, kSinkLog:
+		default:
+			f.Close()
+			return nil, fmt.Errorf("%s: unknown on_error %q", cfg.name(), cfg.OnError)
+		}
+		sink, err := newSink(cfg, committed)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		f.targets = append(f.targets, &fanOutTarget{name: cfg.name(), sink: sink, onError: cfg.OnError})
+	}
+	return f, nil
+}
+
+// handle applies the target's policy to err.
+func (t *fanOutTarget) handle(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	err = fmt.Errorf("%s: %s: %s", t.name, op, err)
+	switch t.onError {
+	case kSinkDisable:
+		log.Errorf("%s; disabling it", err)
+		t.disabled = true
+		t.sink.Close()
+		return nil
+	case kSinkLog:
+		log.Error(err)
+		return nil
+	}
+	return err
+}
+
+func (f *fanOutSink) each(op string, do func(OutputSink) error) error {
+	for _, target := range f.targets {
+		if target.disabled {
+			continue
+		}
+		if err := target.handle(op, do(target.sink)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fanOutSink) Write(batch []outputRecord) error {
+	return f.each("write", func(sink OutputSink) error { return sink.Write(batch) })
+}
+
+func (f *fanOutSink) Flush(checkpoint string) error {
+	return f.each("flush", func(sink OutputSink) error { return sink.Flush(checkpoint) })
+}
+
+func (f *fanOutSink) Committed() error {
+	return f.each("commit", OutputSink.Committed)
+}
+
+// Close closes every sink, even after one failed.
+func (f *fanOutSink) Close() error {
+	var first error
+	for _, target := range f.targets {
+		if target.disabled {
+			continue
+		}
+		if err := target.sink.Close(); err != nil {
+			log.Errorf("%s: close: %s", target.name, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
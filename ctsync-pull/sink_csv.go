@@ -0,0 +1,105 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/teamnsrg/zcrypto/ct"
+)
+
+// csvSink appends each certificate to dir/<year logged>/<first three hex
+// digits of its hash>.csv, or to segments of it.
+type csvSink struct {
+	files *partitionedFiles
+}
+
+func newCSVSink(cfg SinkConfig, committed committedFunc) (*csvSink, error) {
+	opts, err := cfg.partitionOptions()
+	if err != nil {
+		return nil, err
+	}
+	files, err := newPartitionedFiles(cfg.Dir, ".csv", opts, committed)
+	if err != nil {
+		return nil, err
+	}
+	return &csvSink{files: files}, nil
+}
+
+func csvRow(entry *ct.LogEntry) []string {
+	chainBytes := make([]byte, 0)
+	chainB64 := make([]string, len(entry.Chain))
+	for i, c := range entry.Chain {
+		chainBytes = append(chainBytes, c...)
+		chainB64[i] = base64.StdEncoding.EncodeToString(c)
+	}
+
+	chainHash := fmt.Sprintf("%x", sha256.Sum256(chainBytes))
+	var leafB64, leafHash, leafTBSnoCTfingerprint string
+
+	if entry.Leaf.TimestampedEntry.EntryType == ct.X509LogEntryType {
+		leafB64 = base64.StdEncoding.EncodeToString(entry.X509Cert.Raw)
+		leafHash = entry.X509Cert.FingerprintSHA256.Hex()
+		leafTBSnoCTfingerprint = entry.X509Cert.FingerprintNoCT.Hex()
+	} else if entry.Leaf.TimestampedEntry.EntryType == ct.PrecertLogEntryType {
+		leafB64 = base64.StdEncoding.EncodeToString(entry.Precert.Raw)
+		hash := sha256.Sum256(entry.Precert.Raw)
+		leafHash = hex.EncodeToString(hash[:])
+		leafTBSnoCTfingerprint = entry.Precert.TBSCertificate.FingerprintNoCT.Hex()
+	}
+
+	return []string{
+		leafHash,
+		leafTBSnoCTfingerprint,
+		leafB64,
+		//TODO: Add leaf's parent spki+subject fingerprint
+		chainHash,
+		strings.Join(chainB64, "|"),
+	}
+}
+
+func (s *csvSink) Write(batch []outputRecord) error {
+	for _, record := range batch {
+		row := csvRow(record.entry)
+		w, err := s.files.writer(ctLoggedYear(record.entry), row[0][0:3])
+		if err != nil {
+			return err
+		}
+		csvWriter := csv.NewWriter(w)
+		csvWriter.Write(row)
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *csvSink) Flush(checkpoint string) error {
+	return s.files.Flush(checkpoint)
+}
+
+func (s *csvSink) Committed() error {
+	return s.files.Committed()
+}
+
+func (s *csvSink) Close() error {
+	return s.files.Close()
+}
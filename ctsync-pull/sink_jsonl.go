@@ -0,0 +1,172 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/teamnsrg/zcrypto/ct"
+	"github.com/teamnsrg/zcrypto/x509"
+)
+
+// jsonlRecord is one line of the JSONL output.
+type jsonlRecord struct {
+	Log       string `json:"log"`
+	Index     int64  `json:"index"`
+	Timestamp uint64 `json:"timestamp"`
+	// EntryType is "x509" or "precert".
+	EntryType   string `json:"entry_type"`
+	LeafHash    string `json:"leaf_sha256"`
+	TBSNoCTHash string `json:"tbs_noct_sha256"`
+
+	Subject            string           `json:"subject"`
+	Issuer             string           `json:"issuer"`
+	DNSNames           []string         `json:"dns_names,omitempty"`
+	IPAddresses        []string         `json:"ip_addresses,omitempty"`
+	EmailAddresses     []string         `json:"email_addresses,omitempty"`
+	Serial             string           `json:"serial"`
+	NotBefore          time.Time        `json:"not_before"`
+	NotAfter           time.Time        `json:"not_after"`
+	IsCA               bool             `json:"is_ca"`
+	KeyType            string           `json:"key_type"`
+	KeySize            int              `json:"key_size,omitempty"`
+	SignatureAlgorithm string           `json:"signature_algorithm"`
+	Extensions         []jsonlExtension `json:"extensions,omitempty"`
+
+	// Certificate is zcrypto's complete JSON for the certificate, or for
+	// the TBSCertificate of a precertificate.
+	Certificate *x509.Certificate `json:"zcrypto,omitempty"`
+}
+
+type jsonlExtension struct {
+	OID      string `json:"oid"`
+	Critical bool   `json:"critical"`
+}
+
+// jsonlSink writes one JSON object per certificate, partitioned like the CSV
+// output.
+type jsonlSink struct {
+	files    *partitionedFiles
+	fullJSON bool
+}
+
+func newJSONLSink(cfg SinkConfig, committed committedFunc) (*jsonlSink, error) {
+	opts, err := cfg.partitionOptions()
+	if err != nil {
+		return nil, err
+	}
+	files, err := newPartitionedFiles(cfg.Dir, ".jsonl", opts, committed)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonlSink{files: files, fullJSON: cfg.FullJSON}, nil
+}
+
+// keySize is the size in bits of the public keys we know.
+func keySize(key interface{}) int {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return k.N.BitLen()
+	case *dsa.PublicKey:
+		return k.P.BitLen()
+	case *ecdsa.PublicKey:
+		return k.Curve.Params().BitSize
+	case *x509.AugmentedECDSA:
+		if k.Pub != nil {
+			return k.Pub.Curve.Params().BitSize
+		}
+	}
+	return 0
+}
+
+func newJSONLRecord(record outputRecord, fullJSON bool) *jsonlRecord {
+	entry := record.entry
+	res := &jsonlRecord{
+		Log:         record.logName,
+		Index:       entry.Index,
+		Timestamp:   entry.Leaf.TimestampedEntry.Timestamp,
+		LeafHash:    record.hashes.SHA256,
+		TBSNoCTHash: record.hashes.TBS_NO_CT_SHA256,
+	}
+	var cert *x509.Certificate
+	switch entry.Leaf.TimestampedEntry.EntryType {
+	case ct.X509LogEntryType:
+		res.EntryType = "x509"
+		cert = entry.X509Cert
+	case ct.PrecertLogEntryType:
+		res.EntryType = "precert"
+		cert = &entry.Precert.TBSCertificate
+	}
+	if cert == nil {
+		return res
+	}
+	res.Subject = cert.Subject.String()
+	res.Issuer = cert.Issuer.String()
+	res.DNSNames = cert.DNSNames
+	for _, ip := range cert.IPAddresses {
+		res.IPAddresses = append(res.IPAddresses, ip.String())
+	}
+	res.EmailAddresses = cert.EmailAddresses
+	if cert.SerialNumber != nil {
+		res.Serial = fmt.Sprintf("%x", cert.SerialNumber)
+	}
+	res.NotBefore = cert.NotBefore
+	res.NotAfter = cert.NotAfter
+	res.IsCA = cert.IsCA
+	res.KeyType = cert.PublicKeyAlgorithm.String()
+	res.KeySize = keySize(cert.PublicKey)
+	res.SignatureAlgorithm = cert.SignatureAlgorithm.String()
+	for _, extension := range cert.Extensions {
+		res.Extensions = append(res.Extensions, jsonlExtension{OID: extension.Id.String(), Critical: extension.Critical})
+	}
+	if fullJSON {
+		res.Certificate = cert
+	}
+	return res
+}
+
+func (s *jsonlSink) Write(batch []outputRecord) error {
+	for _, record := range batch {
+		line, err := json.Marshal(newJSONLRecord(record, s.fullJSON))
+		if err != nil {
+			return fmt.Errorf("encoding entry %d of %s: %s", record.entry.Index, record.logName, err)
+		}
+		w, err := s.files.writer(ctLoggedYear(record.entry), record.hashes.SHA256[0:3])
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *jsonlSink) Flush(checkpoint string) error {
+	return s.files.Flush(checkpoint)
+}
+
+func (s *jsonlSink) Committed() error {
+	return s.files.Committed()
+}
+
+func (s *jsonlSink) Close() error {
+	return s.files.Close()
+}
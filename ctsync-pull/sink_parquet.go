@@ -0,0 +1,535 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/teamnsrg/zcrypto/ct"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const (
+	kDefaultParquetPrefixLength = 1
+	kDefaultRowGroupBytes       = 16 << 20
+	kDefaultParquetBufferBytes  = 256 << 20
+	kDefaultParquetFileBytes    = 1 << 30
+	kDefaultParquetFileAge      = time.Hour
+	// kParquetTmpSuffix marks files that were not finalized.
+	kParquetTmpSuffix = ".tmp"
+	// kParquetJournalSuffix marks the rows of a file that was not finalized
+	// and renamed yet.
+	kParquetJournalSuffix = ".journal"
+)
+
+// parquetRow is the Parquet schema. Columns may be added but never renamed,
+// retyped or removed.
+type parquetRow struct {
+	LeafSHA256    string   `parquet:"name=leaf_sha256, type=BYTE_ARRAY, convertedtype=UTF8"`
+	TBSNoCTSHA256 string   `parquet:"name=tbs_noct_sha256, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ChainSHA256   string   `parquet:"name=chain_sha256, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Leaf          string   `parquet:"name=leaf, type=BYTE_ARRAY"`
+	Chain         []string `parquet:"name=chain, type=LIST, valuetype=BYTE_ARRAY"`
+
+	Log                string   `parquet:"name=log, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Index              int64    `parquet:"name=index, type=INT64"`
+	Timestamp          int64    `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	EntryType          string   `parquet:"name=entry_type, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Subject            string   `parquet:"name=subject, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Issuer             string   `parquet:"name=issuer, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	DNSNames           []string `parquet:"name=dns_names, type=LIST, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+	IPAddresses        []string `parquet:"name=ip_addresses, type=LIST, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+	EmailAddresses     []string `parquet:"name=email_addresses, type=LIST, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+	Serial             string   `parquet:"name=serial, type=BYTE_ARRAY, convertedtype=UTF8"`
+	NotBefore          int64    `parquet:"name=not_before, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	NotAfter           int64    `parquet:"name=not_after, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	IsCA               bool     `parquet:"name=is_ca, type=BOOLEAN"`
+	KeyType            string   `parquet:"name=key_type, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	KeySize            int32    `parquet:"name=key_size, type=INT32"`
+	SignatureAlgorithm string   `parquet:"name=signature_algorithm, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+}
+
+func newParquetRow(record outputRecord) parquetRow {
+	entry := record.entry
+	meta := newJSONLRecord(record, false)
+	row := parquetRow{
+		LeafSHA256:         meta.LeafHash,
+		TBSNoCTSHA256:      meta.TBSNoCTHash,
+		Log:                meta.Log,
+		Index:              meta.Index,
+		Timestamp:          int64(meta.Timestamp),
+		EntryType:          meta.EntryType,
+		Subject:            meta.Subject,
+		Issuer:             meta.Issuer,
+		DNSNames:           meta.DNSNames,
+		IPAddresses:        meta.IPAddresses,
+		EmailAddresses:     meta.EmailAddresses,
+		Serial:             meta.Serial,
+		IsCA:               meta.IsCA,
+		KeyType:            meta.KeyType,
+		KeySize:            int32(meta.KeySize),
+		SignatureAlgorithm: meta.SignatureAlgorithm,
+	}
+	if !meta.NotBefore.IsZero() {
+		row.NotBefore = meta.NotBefore.UnixNano() / int64(time.Millisecond)
+		row.NotAfter = meta.NotAfter.UnixNano() / int64(time.Millisecond)
+	}
+	switch entry.Leaf.TimestampedEntry.EntryType {
+	case ct.X509LogEntryType:
+		row.Leaf = string(entry.X509Cert.Raw)
+	case ct.PrecertLogEntryType:
+		row.Leaf = string(entry.Precert.Raw)
+	}
+	var chainBytes []byte
+	for _, c := range entry.Chain {
+		chainBytes = append(chainBytes, c...)
+		row.Chain = append(row.Chain, string(c))
+	}
+	row.ChainSHA256 = fmt.Sprintf("%x", sha256.Sum256(chainBytes))
+	return row
+}
+
+// countingFile keeps track of the size of a file that is appended to.
+type countingFile struct {
+	*os.File
+	written int64
+}
+
+func (f *countingFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	f.written += int64(n)
+	return n, err
+}
+
+type parquetFile struct {
+	path   string
+	file   *countingFile
+	writer *writer.ParquetWriter
+	// journal holds the file's rows, gob encoded, until it is renamed.
+	journal *countingFile
+	buffer  *bufio.Writer
+	encoder *gob.Encoder
+	opened  time.Time
+	// buffered estimates the bytes of the rows the writer holds in memory
+	// for the current row group, by their encoded size in the journal.
+	buffered int64
+}
+
+// parquetSink writes certificates to dir/<year logged>/<hash prefix>/*.parquet.
+// A Parquet file is unreadable until its footer is written, so it is written
+// as *.parquet.tmp, and its rows are also appended to *.parquet.journal,
+// which every Flush makes durable. A file is finalized once it reaches
+// maxFileBytes or maxFileAge, when it is evicted, and on Close; it is renamed
+// and its journal removed once the next checkpoint is committed. After a
+// crash, files are rebuilt from their journals.
+type parquetSink struct {
+	dir           string
+	prefixLength  int
+	rowGroupBytes int64
+	// maxBufferBytes caps buffered across the open files; past it, the file
+	// buffering the most writes out its row group early.
+	maxBufferBytes int64
+	buffered       int64
+	maxFileBytes   int64
+	maxFileAge     time.Duration
+	codec          parquet.CompressionCodec
+	checkpoints    *checkpointLog
+	open           map[string]*parquetFile
+	// finalized are the files finalized since the last Flush.
+	finalized []*parquetFile
+	seq       int
+}
+
+func newParquetSink(cfg SinkConfig, committed committedFunc) (*parquetSink, error) {
+	s := &parquetSink{
+		dir:            cfg.Dir,
+		prefixLength:   cfg.PrefixLength,
+		rowGroupBytes:  cfg.RowGroupBytes,
+		maxBufferBytes: cfg.MaxBufferBytes,
+		maxFileBytes:   cfg.MaxFileBytes,
+		maxFileAge:     kDefaultParquetFileAge,
+		open:           make(map[string]*parquetFile),
+	}
+	if s.prefixLength <= 0 {
+		s.prefixLength = kDefaultParquetPrefixLength
+	}
+	if s.prefixLength > 3 {
+		return nil, fmt.Errorf("parquet prefix_length %d is longer than 3", s.prefixLength)
+	}
+	if s.rowGroupBytes <= 0 {
+		s.rowGroupBytes = kDefaultRowGroupBytes
+	}
+	if s.maxBufferBytes <= 0 {
+		s.maxBufferBytes = kDefaultParquetBufferBytes
+	}
+	if s.maxFileBytes <= 0 {
+		s.maxFileBytes = kDefaultParquetFileBytes
+	}
+	if cfg.MaxFileAge != "" {
+		age, err := time.ParseDuration(cfg.MaxFileAge)
+		if err != nil || age <= 0 {
+			return nil, fmt.Errorf("%s: invalid max_file_age %q", cfg.name(), cfg.MaxFileAge)
+		}
+		s.maxFileAge = age
+	}
+	switch cfg.Compression {
+	case "":
+		s.codec = parquet.CompressionCodec_SNAPPY
+	case kGzip:
+		s.codec = parquet.CompressionCodec_GZIP
+	case kZstd:
+		s.codec = parquet.CompressionCodec_ZSTD
+	default:
+		return nil, fmt.Errorf("unknown compression %q", cfg.Compression)
+	}
+	sizes, logged, err := readCheckpointLog(s.dir, committed)
+	if err != nil {
+		return nil, err
+	}
+	// Unfinished files are rebuilt from their journals.
+	var journals []string
+	err = filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		switch {
+		case strings.HasSuffix(path, ".parquet"+kParquetTmpSuffix):
+			return os.Remove(path)
+		case strings.HasSuffix(path, ".parquet"+kParquetJournalSuffix):
+			journals = append(journals, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, journal := range journals {
+		rel, err := filepath.Rel(s.dir, journal)
+		if err != nil {
+			return nil, err
+		}
+		if size, known := sizes[rel]; logged && !known {
+			log.Warnf("removing %s, which was created after the last checkpoint", journal)
+			err = os.Remove(journal)
+		} else if logged {
+			err = s.recover(journal, size)
+		} else {
+			err = s.recover(journal, -1)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.checkpoints, err = newCheckpointLog(s.dir, make(map[string]int64)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// create starts the Parquet file path as path+kParquetTmpSuffix.
+func (s *parquetSink) create(path string) (*countingFile, *writer.ParquetWriter, error) {
+	osFile, err := os.OpenFile(path+kParquetTmpSuffix, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	file := &countingFile{File: osFile}
+	pw, err := writer.NewParquetWriterFromWriter(file, new(parquetRow), 1)
+	if err != nil {
+		osFile.Close()
+		return nil, nil, err
+	}
+	pw.RowGroupSize = s.rowGroupBytes
+	pw.CompressionType = s.codec
+	return file, pw, nil
+}
+
+// recover finalizes the file of a journal left by a crash with the rows in
+// its first size bytes, or all of them if size is negative.
+func (s *parquetSink) recover(journal string, size int64) error {
+	path := strings.TrimSuffix(journal, kParquetJournalSuffix)
+	if _, err := os.Stat(path); err == nil {
+		// The file was renamed, but its journal not removed yet.
+		return os.Remove(journal)
+	}
+	if size >= 0 {
+		if err := os.Truncate(journal, size); err != nil {
+			return err
+		}
+	}
+	in, err := os.Open(journal)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	file, pw, err := s.create(path)
+	if err != nil {
+		return err
+	}
+	decoder := gob.NewDecoder(bufio.NewReader(in))
+	rows := 0
+	for {
+		var row parquetRow
+		if err := decoder.Decode(&row); err != nil {
+			if err != io.EOF {
+				log.Warnf("%s: %s; keeping the %d rows before it", journal, err, rows)
+			}
+			break
+		}
+		if err := pw.Write(row); err != nil {
+			file.Close()
+			return fmt.Errorf("writing %s: %s", path, err)
+		}
+		rows++
+	}
+	f := &parquetFile{path: path, file: file, writer: pw}
+	if err := f.finish(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+kParquetTmpSuffix, path); err != nil {
+		return err
+	}
+	log.Warnf("finished %s left unfinished by a crash, keeping %d rows", path, rows)
+	return os.Remove(journal)
+}
+
+func (s *parquetSink) file(year, prefix string) (*parquetFile, error) {
+	key := filepath.Join(year, prefix)
+	// An evicted file is finalized; it cannot be appended to.
+	id := openFileKey{owner: s, key: key}
+	if err := openFiles.touch(id, func() error { return s.finalize(key) }); err != nil {
+		return nil, err
+	}
+	if f, ok := s.open[key]; ok {
+		return f, nil
+	}
+	if err := os.MkdirAll(filepath.Join(s.dir, key), 0755); err != nil {
+		openFiles.remove(id)
+		return nil, err
+	}
+	s.seq++
+	path := filepath.Join(s.dir, key, fmt.Sprintf("%d-%d.parquet", time.Now().UnixNano(), s.seq))
+	journal, err := os.OpenFile(path+kParquetJournalSuffix, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		openFiles.remove(id)
+		return nil, err
+	}
+	file, pw, err := s.create(path)
+	if err != nil {
+		journal.Close()
+		os.Remove(journal.Name())
+		openFiles.remove(id)
+		return nil, err
+	}
+	f := &parquetFile{path: path, file: file, writer: pw, journal: &countingFile{File: journal}, opened: time.Now()}
+	f.buffer = bufio.NewWriter(f.journal)
+	f.encoder = gob.NewEncoder(f.buffer)
+	s.open[key] = f
+	return f, nil
+}
+
+// finish writes the footer of f and syncs it.
+func (f *parquetFile) finish() error {
+	if err := f.writer.WriteStop(); err != nil {
+		f.file.Close()
+		return fmt.Errorf("finishing %s: %s", f.path, err)
+	}
+	if err := f.file.Sync(); err != nil {
+		f.file.Close()
+		return fmt.Errorf("unable to sync %s: %s", f.path, err)
+	}
+	return f.file.Close()
+}
+
+// sync makes the journal of f durable.
+func (f *parquetFile) sync() error {
+	if err := f.buffer.Flush(); err != nil {
+		return fmt.Errorf("unable to write %s: %s", f.journal.Name(), err)
+	}
+	if err := f.journal.Sync(); err != nil {
+		return fmt.Errorf("unable to sync %s: %s", f.journal.Name(), err)
+	}
+	return nil
+}
+
+// finalize finishes the file under key. It is renamed once the next
+// checkpoint is committed.
+func (s *parquetSink) finalize(key string) error {
+	f := s.open[key]
+	delete(s.open, key)
+	openFiles.remove(openFileKey{owner: s, key: key})
+	s.buffered -= f.buffered
+	if err := f.finish(); err != nil {
+		f.journal.Close()
+		return err
+	}
+	err := f.sync()
+	if closeErr := f.journal.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	s.finalized = append(s.finalized, f)
+	return nil
+}
+
+// rename gives the finalized files their final names and removes their
+// journals.
+func (s *parquetSink) rename() error {
+	for len(s.finalized) > 0 {
+		f := s.finalized[0]
+		if err := os.Rename(f.path+kParquetTmpSuffix, f.path); err != nil {
+			return err
+		}
+		if err := os.Remove(f.journal.Name()); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, f.journal.Name())
+		if err != nil {
+			return err
+		}
+		s.checkpoints.forget(rel)
+		s.finalized = s.finalized[1:]
+	}
+	return nil
+}
+
+func (s *parquetSink) Write(batch []outputRecord) error {
+	for _, record := range batch {
+		year, prefix := ctLoggedYear(record.entry), record.hashes.SHA256[0:s.prefixLength]
+		f, err := s.file(year, prefix)
+		if err != nil {
+			return err
+		}
+		// parquet-go expects rows by value; a pointer would make every
+		// column optional.
+		row := newParquetRow(record)
+		if err := f.writer.Write(row); err != nil {
+			return fmt.Errorf("writing %s: %s", f.path, err)
+		}
+		journaled := f.journal.written + int64(f.buffer.Buffered())
+		if err := f.encoder.Encode(row); err != nil {
+			return fmt.Errorf("writing %s: %s", f.journal.Name(), err)
+		}
+		size := f.journal.written + int64(f.buffer.Buffered()) - journaled
+		f.buffered += size
+		s.buffered += size
+		if f.file.written >= s.maxFileBytes {
+			if err := s.finalize(filepath.Join(year, prefix)); err != nil {
+				return err
+			}
+			continue
+		}
+		if f.buffered >= s.rowGroupBytes {
+			if err := s.flushRowGroup(f); err != nil {
+				return err
+			}
+		}
+		if s.buffered > s.maxBufferBytes {
+			var largest *parquetFile
+			for _, open := range s.open {
+				if largest == nil || open.buffered > largest.buffered {
+					largest = open
+				}
+			}
+			if err := s.flushRowGroup(largest); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// flushRowGroup writes out the row group f buffers.
+func (s *parquetSink) flushRowGroup(f *parquetFile) error {
+	if err := f.writer.Flush(true); err != nil {
+		return fmt.Errorf("writing %s: %s", f.path, err)
+	}
+	s.buffered -= f.buffered
+	f.buffered = 0
+	return nil
+}
+
+// Flush finalizes the files that are due and makes the journals of the
+// others durable, recording their sizes as of checkpoint.
+func (s *parquetSink) Flush(checkpoint string) error {
+	now := time.Now()
+	for key, f := range s.open {
+		if now.Sub(f.opened) >= s.maxFileAge {
+			if err := s.finalize(key); err != nil {
+				return err
+			}
+		}
+	}
+	sizes := make(map[string]int64)
+	record := func(f *parquetFile) error {
+		rel, err := filepath.Rel(s.dir, f.journal.Name())
+		if err != nil {
+			return err
+		}
+		sizes[rel] = f.journal.written
+		return nil
+	}
+	for _, f := range s.open {
+		if err := f.sync(); err != nil {
+			return err
+		}
+		if err := record(f); err != nil {
+			return err
+		}
+	}
+	for _, f := range s.finalized {
+		if err := record(f); err != nil {
+			return err
+		}
+	}
+	return s.checkpoints.prepare(checkpoint, sizes)
+}
+
+// Committed renames the files finalized before the checkpoint.
+func (s *parquetSink) Committed() error {
+	if err := s.checkpoints.commit(); err != nil {
+		return err
+	}
+	return s.rename()
+}
+
+// Close finalizes every open file. It is called after the last checkpoint
+// was committed, so the files are renamed right away.
+func (s *parquetSink) Close() error {
+	var first error
+	for key := range s.open {
+		if err := s.finalize(key); err != nil && first == nil {
+			first = err
+		}
+	}
+	if err := s.rename(); err != nil && first == nil {
+		first = err
+	}
+	if err := s.checkpoints.Close(); err != nil && first == nil {
+		first = err
+	}
+	return first
+}
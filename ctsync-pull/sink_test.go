@@ -0,0 +1,297 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/teamnsrg/zcrypto/ct"
+)
+
+// failingSink counts the records it is given and fails every write.
+type failingSink struct {
+	written int
+	closed  bool
+}
+
+func (s *failingSink) Write(batch []outputRecord) error {
+	s.written += len(batch)
+	return errors.New("disk full")
+}
+
+func (s *failingSink) Flush(checkpoint string) error { return nil }
+
+func (s *failingSink) Committed() error { return nil }
+
+func (s *failingSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestFanOutSinkErrorPolicies(t *testing.T) {
+	batch := []outputRecord{{entry: testLogEntry(1)}}
+	for _, policy := range []string{kSinkFatal, kSinkDisable, kSinkLog} {
+		failing := &failingSink{}
+		healthy := &failingSink{}
+		f := &fanOutSink{targets: []*fanOutTarget{
+			{name: "failing", sink: failing, onError: policy},
+			{name: "other", sink: healthy, onError: kSinkLog},
+		}}
+		first := f.Write(batch)
+		second := f.Write(batch)
+		switch policy {
+		case kSinkFatal:
+			if first == nil {
+				t.Error("fatal sink error was ignored")
+			}
+		case kSinkDisable:
+			if first != nil || second != nil || failing.written != 1 || !failing.closed {
+				t.Errorf("disabled sink: %v %v %+v", first, second, failing)
+			}
+		case kSinkLog:
+			if first != nil || second != nil || failing.written != 2 {
+				t.Errorf("logging sink: %v %v %+v", first, second, failing)
+			}
+		}
+		if policy != kSinkFatal && healthy.written != 2 {
+			t.Errorf("%s: other sink got %d records", policy, healthy.written)
+		}
+	}
+}
+
+func TestNewFanOutSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctsync-sink-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := newFanOutSink([]SinkConfig{{Type: "kafka", Dir: dir}}, notCommitted); err == nil {
+		t.Error("accepted an unknown sink type")
+	}
+	if _, err := newFanOutSink([]SinkConfig{{Type: kCSVSink, Dir: dir, OnError: "retry"}}, notCommitted); err == nil {
+		t.Error("accepted an unknown error policy")
+	}
+	if _, err := newFanOutSink([]SinkConfig{{Type: kCSVSink, Dir: dir}, {Type: kJSONLSink, Dir: dir + "/"}}, notCommitted); err == nil {
+		t.Error("two sinks sharing a dir accepted")
+	}
+	f, err := newFanOutSink([]SinkConfig{{Type: kCSVSink, Dir: dir}}, notCommitted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.targets[0].onError != kSinkFatal {
+		t.Errorf("default policy is %q", f.targets[0].onError)
+	}
+	if err := f.Write([]outputRecord{{entry: testLogEntry(1)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if rows := readCSVRows(t, dir); rows != 1 {
+		t.Errorf("expected 1 row, got %d", rows)
+	}
+}
+
+func TestJSONLSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctsync-sink-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := testLogEntry(7)
+	entry.X509Cert.DNSNames = []string{"example.com"}
+	entry.X509Cert.SerialNumber = big.NewInt(255)
+	entry.X509Cert.PublicKey = key.Public()
+	hashes := &certHashes{SHA256: entry.X509Cert.FingerprintSHA256.Hex(), TBS_NO_CT_SHA256: entry.X509Cert.FingerprintNoCT.Hex()}
+
+	sink, err := newJSONLSink(SinkConfig{Type: kJSONLSink, Dir: dir}, notCommitted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write([]outputRecord{{logName: "test", entry: entry, hashes: hashes}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "2024", hashes.SHA256[0:3]+".jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		t.Fatal("no line written")
+	}
+	var record jsonlRecord
+	if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Log != "test" || record.Index != 7 || record.EntryType != "x509" || record.LeafHash != hashes.SHA256 {
+		t.Errorf("unexpected entry fields %+v", record)
+	}
+	if len(record.DNSNames) != 1 || record.Serial != "ff" || record.KeySize != 256 || record.Certificate != nil {
+		t.Errorf("unexpected certificate fields %+v", record)
+	}
+}
+
+func TestParquetSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctsync-sink-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A file left over from a crash is removed; its rows were not committed.
+	stale := filepath.Join(dir, "2024", "0", "1-1.parquet"+kParquetTmpSuffix)
+	os.MkdirAll(filepath.Dir(stale), 0755)
+	if err := ioutil.WriteFile(stale, []byte("PAR1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sink, err := newParquetSink(SinkConfig{Type: kParquetSink, Dir: dir}, notCommitted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("unfinished file was kept: %v", err)
+	}
+	var batch []outputRecord
+	for i := 0; i < 3; i++ {
+		entry := testLogEntry(i)
+		entry.Chain = []ct.ASN1Cert{{1, 2, 3}}
+		hashes := &certHashes{SHA256: entry.X509Cert.FingerprintSHA256.Hex(), TBS_NO_CT_SHA256: entry.X509Cert.FingerprintNoCT.Hex()}
+		batch = append(batch, outputRecord{logName: "test", entry: entry, hashes: hashes})
+	}
+	if err := sink.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	// A checkpoint only makes the journals durable.
+	if err := sink.Flush("test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Committed(); err != nil {
+		t.Fatal(err)
+	}
+	finished, _ := filepath.Glob(filepath.Join(dir, "2024", "*", "*.parquet"))
+	journals, _ := filepath.Glob(filepath.Join(dir, "2024", "*", "*"+kParquetJournalSuffix))
+	if len(finished) != 0 || len(journals) == 0 {
+		t.Errorf("after Flush: %d finished files and %d journals", len(finished), len(journals))
+	}
+
+	row := newParquetRow(batch[1])
+	if row.Log != "test" || row.Index != 1 || row.LeafSHA256 != batch[1].hashes.SHA256 || row.Leaf != "\x01" {
+		t.Errorf("unexpected row %+v", row)
+	}
+	if len(row.Chain) != 1 || row.Chain[0] != "\x01\x02\x03" || row.Timestamp != 1704067200000 {
+		t.Errorf("unexpected row %+v", row)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	finished, _ = filepath.Glob(filepath.Join(dir, "2024", "*", "*.parquet"))
+	unfinished, _ := filepath.Glob(filepath.Join(dir, "2024", "*", "*.parquet.*"))
+	if len(finished) != len(journals) || len(unfinished) != 0 {
+		t.Errorf("after Close: %d finished and %d unfinished files", len(finished), len(unfinished))
+	}
+}
+
+func TestParquetSinkBufferCap(t *testing.T) {
+	for _, maxBufferBytes := range []int64{1 << 30, 1} {
+		dir, err := ioutil.TempDir("", "ctsync-sink-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		sink, err := newParquetSink(SinkConfig{Type: kParquetSink, Dir: dir, MaxBufferBytes: maxBufferBytes}, notCommitted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			entry := testLogEntry(i)
+			hashes := &certHashes{SHA256: entry.X509Cert.FingerprintSHA256.Hex()}
+			if err := sink.Write([]outputRecord{{logName: "test", entry: entry, hashes: hashes}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var buffered int64
+		for _, f := range sink.open {
+			buffered += f.buffered
+		}
+		if buffered != sink.buffered {
+			t.Errorf("sink counts %d buffered bytes, files %d", sink.buffered, buffered)
+		}
+		if full := maxBufferBytes > 1; (sink.buffered > 0) != full {
+			t.Errorf("%d buffered bytes with max_buffer_bytes %d", sink.buffered, maxBufferBytes)
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParquetSinkRecover(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "ctsync-sink-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		committed := func(checkpoint string) (bool, error) {
+			return keep, nil
+		}
+		cfg := SinkConfig{Type: kParquetSink, Dir: dir}
+		sink, err := newParquetSink(cfg, committed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry := testLogEntry(0)
+		hashes := &certHashes{SHA256: entry.X509Cert.FingerprintSHA256.Hex()}
+		if err := sink.Write([]outputRecord{{logName: "test", entry: entry, hashes: hashes}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Flush("test"); err != nil {
+			t.Fatal(err)
+		}
+		// Simulate a crash: the file is never finalized.
+		for _, f := range sink.open {
+			f.file.Close()
+			f.journal.Close()
+		}
+
+		if _, err := newParquetSink(cfg, committed); err != nil {
+			t.Fatal(err)
+		}
+		finished, _ := filepath.Glob(filepath.Join(dir, "2024", "*", "*.parquet"))
+		unfinished, _ := filepath.Glob(filepath.Join(dir, "2024", "*", "*.parquet.*"))
+		if keep && len(finished) != 1 || !keep && len(finished) != 0 || len(unfinished) != 0 {
+			t.Errorf("checkpoint committed %v: %d finished and %d unfinished files", keep, len(finished), len(unfinished))
+		}
+	}
+}
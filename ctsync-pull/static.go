@@ -0,0 +1,483 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/teamnsrg/zcrypto/ct"
+	"github.com/teamnsrg/zcrypto/x509"
+)
+
+// kTileWidth is the number of entries in a full static CT API data tile.
+const kTileWidth = 256
+
+var errTileNotFound = errors.New("tile not found")
+
+// staticBackend reads logs implementing the static CT API
+// (https://c2sp.org/static-ct-api), such as Sunlight, from their monitoring
+// prefix.
+type staticBackend struct {
+	prefix string
+	// publicKey is the DER SubjectPublicKeyInfo of the log's key, if known,
+	// which picks the log's signature out of a checkpoint.
+	publicKey []byte
+	// treeSize is the size of the last checkpoint fetched, which decides
+	// whether the rightmost tile is full or partial.
+	treeSize int64
+
+	issuersMutex sync.Mutex
+	issuers      map[string]ct.ASN1Cert
+}
+
+// newStaticBackend reads the log at prefix. key is the log's base64 public
+// key, or empty.
+func newStaticBackend(prefix, key string) *staticBackend {
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	// An invalid key fails the STH signature check.
+	publicKey, _ := base64.StdEncoding.DecodeString(key)
+	return &staticBackend{
+		prefix:    prefix,
+		publicKey: publicKey,
+		issuers:   make(map[string]ct.ASN1Cert),
+	}
+}
+
+func (b *staticBackend) fetch(path string) ([]byte, error) {
+	resp, err := ctHTTPClient.Get(b.prefix + path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errTileNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s%s: %s", b.prefix, path, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (b *staticBackend) getSTH() (*ct.SignedTreeHead, error) {
+	body, err := b.fetch("checkpoint")
+	if err != nil {
+		return nil, err
+	}
+	sth, err := parseCheckpoint(body, b.publicKey)
+	if err != nil {
+		return nil, err
+	}
+	b.treeSize = int64(sth.TreeSize)
+	return sth, nil
+}
+
+// getConsistencyProof builds the RFC 6962 proof from the log's hash tiles.
+// The tiles are not trusted: verifyConsistency checks the proof against both
+// roots like one served by an RFC 6962 log.
+func (b *staticBackend) getConsistencyProof(first, second int64) ([][]byte, error) {
+	t := &hashTiles{backend: b, treeSize: second, tiles: make(map[string][]byte)}
+	return t.subproof(first, 0, second, true)
+}
+
+// hashTiles reads the nodes of a tree of treeSize leaves from the log's hash
+// tiles. A tile at level L holds up to kTileWidth nodes of height 8L.
+type hashTiles struct {
+	backend  *staticBackend
+	treeSize int64
+	tiles    map[string][]byte
+}
+
+func (t *hashTiles) tile(level int, n int64) ([]byte, error) {
+	full := fmt.Sprintf("tile/%d/%s", level, tilePath(n))
+	path := full
+	if width := t.treeSize>>uint(8*level) - n*kTileWidth; width < kTileWidth {
+		path = fmt.Sprintf("%s.p/%d", full, width)
+	}
+	if tile, ok := t.tiles[path]; ok {
+		return tile, nil
+	}
+	tile, err := t.backend.fetch(path)
+	if err == errTileNotFound && path != full {
+		// The log may have grown and replaced the partial tile.
+		tile, err = t.backend.fetch(full)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fetching hash tile %d/%d: %s", level, n, err)
+	}
+	t.tiles[path] = tile
+	return tile, nil
+}
+
+// node returns the hash of the perfect subtree of the given height covering
+// leaves [index<<height, (index+1)<<height).
+func (t *hashTiles) node(height uint, index int64) ([]byte, error) {
+	level, rest := height/8, height%8
+	first := index << rest
+	tile, err := t.tile(int(level), first/kTileWidth)
+	if err != nil {
+		return nil, err
+	}
+	var hashes [][]byte
+	for i := first; i < (index+1)<<rest; i++ {
+		offset := (i % kTileWidth) * sha256.Size
+		if int64(len(tile)) < offset+sha256.Size {
+			return nil, fmt.Errorf("hash tile %d/%d is too short", level, first/kTileWidth)
+		}
+		hashes = append(hashes, tile[offset:offset+sha256.Size])
+	}
+	for len(hashes) > 1 {
+		for i := 0; i < len(hashes)/2; i++ {
+			hashes[i] = hashChildren(hashes[2*i], hashes[2*i+1])
+		}
+		hashes = hashes[:len(hashes)/2]
+	}
+	return hashes[0], nil
+}
+
+// root is the Merkle tree hash of leaves [start, end).
+func (t *hashTiles) root(start, end int64) ([]byte, error) {
+	n := end - start
+	if n&(n-1) == 0 && start%n == 0 {
+		height := uint(0)
+		for int64(1)<<height < n {
+			height++
+		}
+		return t.node(height, start>>height)
+	}
+	k := largestPowerOfTwoBelow(n)
+	left, err := t.root(start, start+k)
+	if err != nil {
+		return nil, err
+	}
+	right, err := t.root(start+k, end)
+	if err != nil {
+		return nil, err
+	}
+	return hashChildren(left, right), nil
+}
+
+// subproof follows SUBPROOF(m, D[start:end], whole) of RFC 6962 section
+// 2.1.2.
+func (t *hashTiles) subproof(m, start, end int64, whole bool) ([][]byte, error) {
+	if m == end-start {
+		if whole {
+			return nil, nil
+		}
+		root, err := t.root(start, end)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{root}, nil
+	}
+	k := largestPowerOfTwoBelow(end - start)
+	var proof [][]byte
+	var sibling []byte
+	var err error
+	if m <= k {
+		if proof, err = t.subproof(m, start, start+k, whole); err == nil {
+			sibling, err = t.root(start+k, end)
+		}
+	} else {
+		if proof, err = t.subproof(m-k, start+k, end, false); err == nil {
+			sibling, err = t.root(start, start+k)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(proof, sibling), nil
+}
+
+// largestPowerOfTwoBelow returns the largest power of two less than n > 1.
+func largestPowerOfTwoBelow(n int64) int64 {
+	k := int64(1)
+	for k*2 < n {
+		k *= 2
+	}
+	return k
+}
+
+// noteKeyID is the key ID of the log's RFC 6962 note signatures: the first
+// four bytes of SHA-256(origin || "\n" || 0x05 || SubjectPublicKeyInfo).
+func noteKeyID(origin string, publicKey []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(origin + "\n"))
+	h.Write([]byte{0x05})
+	h.Write(publicKey)
+	return h.Sum(nil)[:4]
+}
+
+// parseCheckpoint turns a checkpoint note into the equivalent RFC 6962 STH.
+// The log's own note signature carries the RFC 6962 timestamp and tree head
+// signature, so the result can be verified like any other STH. If publicKey
+// is set, only a signature with its key ID is taken.
+func parseCheckpoint(note []byte, publicKey []byte) (*ct.SignedTreeHead, error) {
+	parts := strings.SplitN(string(note), "\n\n", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("malformed checkpoint: no signatures")
+	}
+	lines := strings.Split(parts[0], "\n")
+	if len(lines) < 3 {
+		return nil, errors.New("malformed checkpoint: too few lines")
+	}
+	origin := lines[0]
+	treeSize, err := strconv.ParseUint(lines[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed checkpoint tree size: %s", err)
+	}
+	rootHash, err := base64.StdEncoding.DecodeString(lines[2])
+	if err != nil || len(rootHash) != 32 {
+		return nil, fmt.Errorf("malformed checkpoint root hash %q", lines[2])
+	}
+	sth := &ct.SignedTreeHead{Version: ct.V1, TreeSize: treeSize}
+	copy(sth.SHA256RootHash[:], rootHash)
+
+	for _, line := range strings.Split(parts[1], "\n") {
+		fields := strings.Fields(strings.TrimPrefix(line, "— "))
+		if len(fields) != 2 || fields[0] != origin {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(fields[1])
+		// key ID (4) || timestamp (8) || hash (1) || signature algorithm (1) || signature<0..2^16-1>
+		if err != nil || len(sig) < 16 {
+			continue
+		}
+		sigLen := int(binary.BigEndian.Uint16(sig[14:16]))
+		if len(sig) != 16+sigLen {
+			continue
+		}
+		if publicKey != nil && !bytes.Equal(sig[0:4], noteKeyID(origin, publicKey)) {
+			continue
+		}
+		sth.Timestamp = binary.BigEndian.Uint64(sig[4:12])
+		sth.TreeHeadSignature = ct.DigitallySigned{
+			HashAlgorithm:      ct.HashAlgorithm(sig[12]),
+			SignatureAlgorithm: ct.SignatureAlgorithm(sig[13]),
+			Signature:          sig[16:],
+		}
+		return sth, nil
+	}
+	return nil, fmt.Errorf("checkpoint has no signature from %s", origin)
+}
+
+// tilePath encodes a tile index as groups of three digits, all but the last
+// prefixed with "x", e.g. 1234067 becomes "x001/x234/067".
+func tilePath(n int64) string {
+	path := fmt.Sprintf("%03d", n%1000)
+	for n >= 1000 {
+		n /= 1000
+		path = fmt.Sprintf("x%03d/%s", n%1000, path)
+	}
+	return path
+}
+
+func (b *staticBackend) fetchDataTile(n int64) ([]byte, error) {
+	width := b.treeSize - n*kTileWidth
+	if width >= kTileWidth {
+		return b.fetch("tile/data/" + tilePath(n))
+	}
+	tile, err := b.fetch(fmt.Sprintf("tile/data/%s.p/%d", tilePath(n), width))
+	if err == errTileNotFound {
+		// The log may have grown and replaced the partial tile since our
+		// last checkpoint.
+		return b.fetch("tile/data/" + tilePath(n))
+	}
+	return tile, err
+}
+
+func (b *staticBackend) issuer(fingerprint []byte) (ct.ASN1Cert, error) {
+	key := hex.EncodeToString(fingerprint)
+	b.issuersMutex.Lock()
+	cert, ok := b.issuers[key]
+	b.issuersMutex.Unlock()
+	if ok {
+		return cert, nil
+	}
+	cert, err := b.fetch("issuer/" + key)
+	if err != nil {
+		return nil, fmt.Errorf("fetching issuer %s: %s", key, err)
+	}
+	b.issuersMutex.Lock()
+	b.issuers[key] = cert
+	b.issuersMutex.Unlock()
+	return cert, nil
+}
+
+// tileLeaf is one entry of a data tile: the RFC 6962 timestamped entry plus
+// the precertificate and the fingerprints of the issuers in the chain.
+type tileLeaf struct {
+	entry        ct.TimestampedEntry
+	precert      ct.ASN1Cert
+	fingerprints [][]byte
+}
+
+type tileReader struct {
+	buf []byte
+	err error
+}
+
+func (r *tileReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf) < n {
+		r.err = errors.New("truncated data tile")
+		return nil
+	}
+	res := r.buf[:n]
+	r.buf = r.buf[n:]
+	return res
+}
+
+func (r *tileReader) uint(n int) uint64 {
+	var res uint64
+	for _, b := range r.next(n) {
+		res = res<<8 | uint64(b)
+	}
+	return res
+}
+
+func (r *tileReader) vector(lenBytes int) []byte {
+	return r.next(int(r.uint(lenBytes)))
+}
+
+func parseDataTile(tile []byte) ([]tileLeaf, error) {
+	r := &tileReader{buf: tile}
+	var leaves []tileLeaf
+	for len(r.buf) > 0 {
+		var leaf tileLeaf
+		leaf.entry.Timestamp = r.uint(8)
+		leaf.entry.EntryType = ct.LogEntryType(r.uint(2))
+		switch leaf.entry.EntryType {
+		case ct.X509LogEntryType:
+			leaf.entry.X509Entry = r.vector(3)
+			leaf.entry.Extensions = r.vector(2)
+		case ct.PrecertLogEntryType:
+			copy(leaf.entry.PrecertEntry.IssuerKeyHash[:], r.next(32))
+			leaf.entry.PrecertEntry.TBSCertificate = r.vector(3)
+			leaf.entry.Extensions = r.vector(2)
+			leaf.precert = r.vector(3)
+		default:
+			return nil, fmt.Errorf("unknown entry type %d in data tile", leaf.entry.EntryType)
+		}
+		chain := r.vector(2)
+		for len(chain) >= 32 {
+			leaf.fingerprints = append(leaf.fingerprints, chain[:32])
+			chain = chain[32:]
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		leaves = append(leaves, leaf)
+	}
+	return leaves, nil
+}
+
+// chain resolves the leaf's issuer fingerprints.
+func (b *staticBackend) chain(leaf tileLeaf) ([]ct.ASN1Cert, error) {
+	var chain []ct.ASN1Cert
+	for _, fingerprint := range leaf.fingerprints {
+		cert, err := b.issuer(fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cert)
+	}
+	return chain, nil
+}
+
+// buildLogEntry builds the same *ct.LogEntry zcrypto's scanner produces,
+// parsing the certificate or precertificate TBS.
+func buildLogEntry(index int64, timestamped ct.TimestampedEntry, precert ct.ASN1Cert, chain []ct.ASN1Cert) (*ct.LogEntry, error) {
+	entry := &ct.LogEntry{
+		Index: index,
+		Leaf: ct.MerkleTreeLeaf{
+			Version:          ct.V1,
+			LeafType:         ct.TimestampedEntryLeafType,
+			TimestampedEntry: timestamped,
+		},
+		Chain: chain,
+	}
+	switch timestamped.EntryType {
+	case ct.X509LogEntryType:
+		cert, err := x509.ParseCertificate(timestamped.X509Entry)
+		if err != nil {
+			return nil, err
+		}
+		entry.X509Cert = cert
+	case ct.PrecertLogEntryType:
+		tbs, err := x509.ParseTBSCertificate(timestamped.PrecertEntry.TBSCertificate)
+		if err != nil {
+			return nil, err
+		}
+		entry.Precert = &ct.Precertificate{
+			Raw:            precert,
+			IssuerKeyHash:  timestamped.PrecertEntry.IssuerKeyHash,
+			TBSCertificate: *tbs,
+		}
+	}
+	return entry, nil
+}
+
+// scan reads whole tiles, so tuner does not apply.
+func (b *staticBackend) scan(l CTLogInfo, start, end int64, numMatch int, tuner *batchTuner, found func(*ct.LogEntry), unparseable unparseableFunc, updater chan int64) (int64, error) {
+	index := start
+	for index < end {
+		n := index / kTileWidth
+		tile, err := b.fetchDataTile(n)
+		if err != nil {
+			return index, fmt.Errorf("fetching data tile %d: %s", n, err)
+		}
+		leaves, err := parseDataTile(tile)
+		if err != nil {
+			return index, fmt.Errorf("parsing data tile %d: %s", n, err)
+		}
+		for ; index < end && index-n*kTileWidth < int64(len(leaves)); index++ {
+			leaf := leaves[index-n*kTileWidth]
+			chain, err := b.chain(leaf)
+			if err != nil {
+				return index, fmt.Errorf("fetching issuers of entry %d: %s", index, err)
+			}
+			entry, err := buildLogEntry(index, leaf.entry, leaf.precert, chain)
+			if err != nil {
+				unparseable(index, merkleTreeLeafInput(&ct.MerkleTreeLeaf{
+					Version:          ct.V1,
+					LeafType:         ct.TimestampedEntryLeafType,
+					TimestampedEntry: leaf.entry,
+				}), err)
+				continue
+			}
+			found(entry)
+		}
+		if index < end && index < (n+1)*kTileWidth {
+			return index, fmt.Errorf("data tile %d ends at entry %d", n, index)
+		}
+		updater <- index
+	}
+	return index, nil
+}
@@ -0,0 +1,214 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/teamnsrg/zcrypto/ct"
+)
+
+func (leaf tileLeaf) marshal() []byte {
+	var buf bytes.Buffer
+	putUint := func(v uint64, n int) {
+		for i := n - 1; i >= 0; i-- {
+			buf.WriteByte(byte(v >> (8 * uint(i))))
+		}
+	}
+	putVector := func(v []byte, n int) {
+		putUint(uint64(len(v)), n)
+		buf.Write(v)
+	}
+	putUint(leaf.entry.Timestamp, 8)
+	putUint(uint64(leaf.entry.EntryType), 2)
+	if leaf.entry.EntryType == ct.PrecertLogEntryType {
+		buf.Write(leaf.entry.PrecertEntry.IssuerKeyHash[:])
+		putVector(leaf.entry.PrecertEntry.TBSCertificate, 3)
+		putVector(leaf.entry.Extensions, 2)
+		putVector(leaf.precert, 3)
+	} else {
+		putVector(leaf.entry.X509Entry, 3)
+		putVector(leaf.entry.Extensions, 2)
+	}
+	putVector(bytes.Join(leaf.fingerprints, nil), 2)
+	return buf.Bytes()
+}
+
+func TestTilePath(t *testing.T) {
+	tests := map[int64]string{
+		0:       "000",
+		5:       "005",
+		999:     "999",
+		1000:    "x001/000",
+		1234067: "x001/x234/067",
+	}
+	for n, expected := range tests {
+		if path := tilePath(n); path != expected {
+			t.Errorf("%d: expected %s, got %s", n, expected, path)
+		}
+	}
+}
+
+func TestParseCheckpoint(t *testing.T) {
+	root := bytes.Repeat([]byte{0xab}, 32)
+	sig := make([]byte, 16, 16+3)
+	copy(sig[0:4], []byte{1, 2, 3, 4})
+	binary.BigEndian.PutUint64(sig[4:12], 1700000000000)
+	sig[12] = byte(ct.SHA256)
+	sig[13] = byte(ct.ECDSA)
+	binary.BigEndian.PutUint16(sig[14:16], 3)
+	sig = append(sig, 7, 8, 9)
+
+	note := "example.com/log2024\n" +
+		"1234\n" +
+		base64.StdEncoding.EncodeToString(root) + "\n" +
+		"\n" +
+		"— witness.example AAAAAAAA\n" +
+		"— example.com/log2024 " + base64.StdEncoding.EncodeToString(sig) + "\n"
+	sth, err := parseCheckpoint([]byte(note), nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if sth.TreeSize != 1234 || sth.Timestamp != 1700000000000 || !bytes.Equal(sth.SHA256RootHash[:], root) {
+		t.Errorf("unexpected STH: %+v", sth)
+	}
+	if sth.TreeHeadSignature.SignatureAlgorithm != ct.ECDSA || !bytes.Equal(sth.TreeHeadSignature.Signature, []byte{7, 8, 9}) {
+		t.Errorf("unexpected signature: %+v", sth.TreeHeadSignature)
+	}
+
+	if _, err := parseCheckpoint([]byte("example.com/log2024\n1234\n"+base64.StdEncoding.EncodeToString(root)+"\n"), nil); err == nil {
+		t.Error("unsigned checkpoint accepted")
+	}
+
+	// With the log's key, a signature under the same name by another key is
+	// skipped.
+	publicKey := []byte("spki")
+	keyed := append([]byte(nil), sig...)
+	copy(keyed[0:4], noteKeyID("example.com/log2024", publicKey))
+	keyed[len(keyed)-1] = 10
+	note += "— example.com/log2024 " + base64.StdEncoding.EncodeToString(keyed) + "\n"
+	if sth, err = parseCheckpoint([]byte(note), publicKey); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sth.TreeHeadSignature.Signature, []byte{7, 8, 10}) {
+		t.Errorf("took the signature of another key: %+v", sth.TreeHeadSignature)
+	}
+}
+
+// serveHashTiles serves the level 0 and 1 hash tiles of a tree of leaves.
+func serveHashTiles(leaves [][]byte) *httptest.Server {
+	levels := make([][][]byte, 2)
+	for _, leaf := range leaves {
+		levels[0] = append(levels[0], leafHash(leaf))
+	}
+	for i := 0; i+kTileWidth <= len(leaves); i += kTileWidth {
+		levels[1] = append(levels[1], referenceRoot(leaves[i:i+kTileWidth]))
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for level, hashes := range levels {
+			for n := int64(0); n*kTileWidth < int64(len(hashes)); n++ {
+				end := int64(len(hashes))
+				path := fmt.Sprintf("/tile/%d/%s", level, tilePath(n))
+				if end-n*kTileWidth < kTileWidth {
+					path += fmt.Sprintf(".p/%d", end-n*kTileWidth)
+				} else {
+					end = (n + 1) * kTileWidth
+				}
+				if r.URL.Path == path {
+					for _, hash := range hashes[n*kTileWidth : end] {
+						w.Write(hash)
+					}
+					return
+				}
+			}
+		}
+		http.NotFound(w, r)
+	}))
+}
+
+func TestStaticConsistencyProof(t *testing.T) {
+	leaves := testLeaves(600)
+	server := serveHashTiles(leaves)
+	defer server.Close()
+	b := newStaticBackend(server.URL, "")
+
+	for _, first := range []int64{1, 7, 256, 300, 512, 599} {
+		proof, err := b.getConsistencyProof(first, int64(len(leaves)))
+		if err != nil {
+			t.Fatalf("%d: %s", first, err)
+		}
+		expected := referenceSubproof(int(first), leaves, true)
+		if !reflect.DeepEqual(proof, expected) {
+			t.Errorf("%d: proof differs from RFC 6962", first)
+		}
+		if err := verifyConsistency(first, int64(len(leaves)), referenceRoot(leaves[:first]), referenceRoot(leaves), proof); err != nil {
+			t.Errorf("%d: %s", first, err)
+		}
+	}
+
+	if _, err := b.getConsistencyProof(300, 700); err == nil || !strings.Contains(err.Error(), "hash tile") {
+		t.Errorf("expected a missing hash tile error, got %v", err)
+	}
+}
+
+func TestParseDataTile(t *testing.T) {
+	x509Leaf := tileLeaf{
+		entry: ct.TimestampedEntry{
+			Timestamp:  1700000000000,
+			EntryType:  ct.X509LogEntryType,
+			X509Entry:  ct.ASN1Cert{1, 2, 3},
+			Extensions: ct.CTExtensions{0, 0, 5, 0, 0, 0, 0, 1},
+		},
+		fingerprints: [][]byte{bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)},
+	}
+	precertLeaf := tileLeaf{
+		entry: ct.TimestampedEntry{
+			Timestamp:    1700000000001,
+			EntryType:    ct.PrecertLogEntryType,
+			PrecertEntry: ct.PreCert{TBSCertificate: []byte{4, 5, 6}},
+			Extensions:   ct.CTExtensions{},
+		},
+		precert:      ct.ASN1Cert{7, 8, 9},
+		fingerprints: [][]byte{bytes.Repeat([]byte{3}, 32)},
+	}
+	precertLeaf.entry.PrecertEntry.IssuerKeyHash[0] = 0xff
+
+	tile := append(x509Leaf.marshal(), precertLeaf.marshal()...)
+	leaves, err := parseDataTile(tile)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(leaves) != 2 {
+		t.Fatalf("expected 2 leaves, got %d", len(leaves))
+	}
+	if !reflect.DeepEqual(leaves[0], x509Leaf) {
+		t.Errorf("x509 leaf: expected %+v, got %+v", x509Leaf, leaves[0])
+	}
+	if !reflect.DeepEqual(leaves[1], precertLeaf) {
+		t.Errorf("precert leaf: expected %+v, got %+v", precertLeaf, leaves[1])
+	}
+
+	if _, err := parseDataTile(tile[:len(tile)-1]); err == nil {
+		t.Error("truncated tile accepted")
+	}
+}
@@ -0,0 +1,60 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// syncStatus describes the log's SyncState as last saved by a running
+// ctsync-pull.
+func syncStatus(l CTLogInfo, now time.Time) string {
+	switch {
+	case l.Complete:
+		return kLogCompleted
+	case l.SyncState == kLogBackingOff:
+		return fmt.Sprintf("%s until %s", kLogBackingOff, l.RetryAt.Format("2006-01-02 15:04:05"))
+	case l.SyncState == kLogFailed:
+		return kLogFailed
+	case l.shardExpired(now):
+		return "expired"
+	case l.SyncState == "":
+		return "not started"
+	}
+	return l.SyncState
+}
+
+// printStatus writes one line per configured log with its sync progress as
+// recorded in the progress database.
+func printStatus(out io.Writer, configuration Configuration) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATE\tSHARD\tLAST INDEX\tMISSING\tSTATUS\tERROR")
+	now := time.Now()
+	for _, l := range configuration {
+		state := l.State.Name()
+		if state == "" {
+			state = "-"
+		}
+		shard := "-"
+		if l.TemporalInterval != nil {
+			shard = fmt.Sprintf("%s..%s", l.TemporalInterval.StartInclusive.Format("2006-01-02"), l.TemporalInterval.EndExclusive.Format("2006-01-02"))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\t%s\n", l.Name, state, shard, l.LastIndex, missingEntries(l.Gaps), syncStatus(l, now), l.SyncError)
+	}
+	w.Flush()
+}
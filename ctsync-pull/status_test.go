@@ -0,0 +1,57 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyncStatus(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var l CTLogInfo
+	if status := syncStatus(l, now); status != "not started" {
+		t.Errorf("unexpected status %q", status)
+	}
+	l.setSyncState(kLogBackingOff, errors.New("boom"), now.Add(time.Hour))
+	if status := syncStatus(l, now); status != "backing-off until 2024-01-01 01:00:00" {
+		t.Errorf("unexpected status %q", status)
+	}
+	l.setSyncState(kLogRunning, nil, time.Time{})
+	if status := syncStatus(l, now); status != kLogRunning || l.SyncError != "" {
+		t.Errorf("unexpected status %q (%q)", status, l.SyncError)
+	}
+	l.Complete = true
+	if status := syncStatus(l, now); status != kLogCompleted {
+		t.Errorf("unexpected status %q", status)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	delays := []time.Duration{}
+	for failures := 1; failures <= 8; failures++ {
+		delays = append(delays, backoffDelay(failures, time.Minute, time.Hour))
+	}
+	var got []string
+	for _, d := range delays {
+		got = append(got, d.String())
+	}
+	want := "1m0s 2m0s 4m0s 8m0s 16m0s 32m0s 1h0m0s 1h0m0s"
+	if strings.Join(got, " ") != want {
+		t.Errorf("got %s, want %s", strings.Join(got, " "), want)
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// kSlowResponse is the get-entries latency above which we fetch with
+	// fewer requests in parallel.
+	kSlowResponse = 10 * time.Second
+	// kTuneInterval is how many full, fast responses in a row it takes to
+	// try more parallel requests or a larger batch.
+	kTuneInterval = 50
+)
+
+// batchTuner adapts the get-entries batch size and the number of parallel
+// requests to what one log actually serves. The configured BatchSize,
+// -fetchers and the operator's fetchers are upper bounds.
+type batchTuner struct {
+	name        string
+	maxBatch    int64
+	maxFetchers int
+	// pool is shared with the operator's other logs.
+	pool fetcherPool
+
+	batch    int64
+	fetchers int
+	// served is the most entries the log returned in one response.
+	served int64
+	// streak counts full, fast responses since the last change.
+	streak int
+}
+
+// newBatchTuner starts from the values tuned in earlier runs, if any. operator
+// may be nil.
+func newBatchTuner(l CTLogInfo, maxFetchers int, operator *OperatorInfo) *batchTuner {
+	var pool fetcherPool
+	if operator != nil && operator.Fetchers > 0 {
+		pool = operator.pool
+		if operator.Fetchers < maxFetchers {
+			maxFetchers = operator.Fetchers
+		}
+	}
+	if maxFetchers < 1 {
+		maxFetchers = 1
+	}
+	maxBatch := l.BatchSize
+	if maxBatch < 1 {
+		maxBatch = kDefaultBatchSize
+	}
+	t := &batchTuner{
+		name:        l.Name,
+		maxBatch:    maxBatch,
+		maxFetchers: maxFetchers,
+		pool:        pool,
+		batch:       maxBatch,
+		fetchers:    maxFetchers,
+	}
+	if l.TunedBatchSize > 0 && l.TunedBatchSize < maxBatch {
+		t.batch = l.TunedBatchSize
+	}
+	if l.TunedFetchers > 0 && l.TunedFetchers < maxFetchers {
+		t.fetchers = l.TunedFetchers
+	}
+	return t
+}
+
+// observe records one get-entries response of got entries for a request of
+// requested entries.
+func (t *batchTuner) observe(requested, got int64, latency time.Duration) {
+	if got > t.served {
+		t.served = got
+	}
+	switch {
+	case got == 0:
+		return
+	case got < requested:
+		// Logs cap the number of entries per response; ask for no more. A
+		// log may also stop a response short at its own page boundaries, so
+		// the cap is the most entries it returned at once.
+		t.streak = 0
+		if t.served >= t.batch {
+			return
+		}
+		log.Infof("%s: log serves at most %d entries per request", t.name, t.served)
+		t.batch = t.served
+	case latency > kSlowResponse:
+		t.slowDown("slow responses")
+	case requested == t.batch:
+		t.streak++
+		if t.streak < kTuneInterval {
+			return
+		}
+		t.streak = 0
+		if t.fetchers < t.maxFetchers {
+			t.fetchers++
+		} else if t.batch < t.maxBatch {
+			// See whether the log serves more now.
+			t.batch *= 2
+			if t.batch > t.maxBatch {
+				t.batch = t.maxBatch
+			}
+		}
+	}
+}
+
+// rateLimited records a 429 or 503 response.
+func (t *batchTuner) rateLimited() {
+	t.slowDown("rate limited")
+}
+
+func (t *batchTuner) slowDown(reason string) {
+	t.streak = 0
+	if t.fetchers > 1 {
+		t.fetchers /= 2
+		log.Infof("%s: %s, fetching with %d parallel requests", t.name, reason, t.fetchers)
+	}
+}
+
+// save stores the tuned values in l for the progress database.
+func (t *batchTuner) save(l *CTLogInfo) {
+	l.TunedBatchSize = t.batch
+	l.TunedFetchers = t.fetchers
+}
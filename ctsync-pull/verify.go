@@ -0,0 +1,90 @@
+/*
+ *  CTSync Daemon Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/teamnsrg/zcrypto/ct"
+)
+
+// inconsistentLogError means the log has presented a view of its tree that
+// cannot be reconciled with one it presented before. Unlike network errors it
+// is never retried.
+type inconsistentLogError struct {
+	msg string
+}
+
+func (e *inconsistentLogError) Error() string {
+	return e.msg
+}
+
+func verifySTHSignature(l CTLogInfo, sth *ct.SignedTreeHead) error {
+	if l.Key == "" {
+		return nil
+	}
+	pk, _, err := ct.PublicKeyFromB64(l.Key)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %s", err)
+	}
+	verifier, err := ct.NewSignatureVerifier(pk)
+	if err != nil {
+		return err
+	}
+	return verifier.VerifySTHSignature(*sth)
+}
+
+// verifyConsistencyWithLastSTH checks that the connection's STH is an
+// append-only extension of the last STH we verified for this log. A smaller
+// STH that is also older, as a lagging frontend may serve, is a plain error
+// to be retried.
+func verifyConsistencyWithLastSTH(l CTLogInfo, c *LogServerConnection) error {
+	if l.STHTreeSize == 0 {
+		return nil
+	}
+	lastRoot, err := base64.StdEncoding.DecodeString(l.STHRootHash)
+	if err != nil {
+		return fmt.Errorf("stored STH root hash is corrupt: %s", err)
+	}
+	newRoot := c.sth.SHA256RootHash[:]
+	switch {
+	case c.treeSize < l.STHTreeSize:
+		if int64(c.sth.Timestamp) < l.STHTimestamp {
+			return fmt.Errorf("stale STH: tree size %d is older than verified tree size %d", c.treeSize, l.STHTreeSize)
+		}
+		return &inconsistentLogError{fmt.Sprintf("tree shrank from %d to %d", l.STHTreeSize, c.treeSize)}
+	case c.treeSize == l.STHTreeSize:
+		if !bytes.Equal(lastRoot, newRoot) {
+			return &inconsistentLogError{fmt.Sprintf("split view: two different roots for tree size %d", c.treeSize)}
+		}
+		return nil
+	}
+	proof, err := c.backend.getConsistencyProof(l.STHTreeSize, c.treeSize)
+	if err != nil {
+		return err
+	}
+	if err := verifyConsistency(l.STHTreeSize, c.treeSize, lastRoot, newRoot, proof); err != nil {
+		return &inconsistentLogError{fmt.Sprintf("consistency proof from %d to %d failed: %s", l.STHTreeSize, c.treeSize, err)}
+	}
+	return nil
+}
+
+func (l *CTLogInfo) setVerifiedSTH(sth *ct.SignedTreeHead) {
+	l.STHTreeSize = int64(sth.TreeSize)
+	l.STHTimestamp = int64(sth.Timestamp)
+	l.STHRootHash = base64.StdEncoding.EncodeToString(sth.SHA256RootHash[:])
+}
@@ -7,6 +7,10 @@ CREATE TABLE downloaded_certs (
     TBS_NO_CT_SHA256 bytea NOT NULL
 );
 
+CREATE TABLE ctsync_checkpoints (
+    checkpoint TEXT NOT NULL PRIMARY KEY
+);
+
 GRANT ALL ON ALL TABLES IN SCHEMA public TO ctdownloader;
 GRANT ALL ON ALL SEQUENCES IN SCHEMA public TO ctdownloader;
 
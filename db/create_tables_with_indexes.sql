@@ -7,6 +7,10 @@ CREATE TABLE downloaded_certs (
     TBS_NO_CT_SHA256 bytea NOT NULL
 );
 
+CREATE TABLE ctsync_checkpoints (
+    checkpoint TEXT NOT NULL PRIMARY KEY
+);
+
 CREATE UNIQUE INDEX downloaded_certs_sha256
     ON downloaded_certs (SHA256);
 
@@ -2,6 +2,8 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/google/uuid"
@@ -9,6 +11,7 @@ import (
 	"github.com/pkg/profile"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"io/ioutil"
 	"os"
 	"runtime"
 	"strings"
@@ -53,6 +56,88 @@ func insertBuilder(values [][]string) string {
 	return str.String()
 }
 
+// postgresConfig is the subset of ctsync-pull's -postgres-config file that
+// says where to connect. Settings left empty fall back to lib/pq's PGHOST,
+// PGPORT, PGUSER, ... environment variables.
+type postgresConfig struct {
+	DSN          string `json:"dsn"`
+	Host         string `json:"host"`
+	Port         int    `json:"port"`
+	User         string `json:"user"`
+	DBName       string `json:"dbname"`
+	SSLMode      string `json:"sslmode"`
+	SSLRootCert  string `json:"sslrootcert"`
+	SSLCert      string `json:"sslcert"`
+	SSLKey       string `json:"sslkey"`
+	PasswordFile string `json:"password_file"`
+}
+
+var postgresEnvironment = []string{
+	"PGHOST", "PGHOSTADDR", "PGPORT", "PGDATABASE", "PGUSER", "PGPASSWORD",
+	"PGPASSFILE", "PGSERVICE", "PGSERVICEFILE", "PGSSLMODE", "PGSSLCERT",
+	"PGSSLKEY", "PGSSLROOTCERT", "PGREQUIRESSL", "PGCONNECT_TIMEOUT",
+	"PGOPTIONS", "PGAPPNAME",
+}
+
+func quoteDSNValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `'`, `\'`, -1)
+	return "'" + value + "'"
+}
+
+// connectionString builds the connection string the same way ctsync-pull
+// does, defaulting to the local ctdownload socket.
+func (c postgresConfig) connectionString() (string, error) {
+	params := []string{}
+	add := func(key, value string) {
+		if value != "" {
+			params = append(params, key+"="+quoteDSNValue(value))
+		}
+	}
+	add("host", c.Host)
+	if c.Port != 0 {
+		add("port", fmt.Sprint(c.Port))
+	}
+	add("user", c.User)
+	add("dbname", c.DBName)
+	add("sslmode", c.SSLMode)
+	add("sslrootcert", c.SSLRootCert)
+	add("sslcert", c.SSLCert)
+	add("sslkey", c.SSLKey)
+	if c.PasswordFile != "" {
+		password, err := ioutil.ReadFile(c.PasswordFile)
+		if err != nil {
+			return "", err
+		}
+		add("password", strings.TrimRight(string(password), "\r\n"))
+	}
+
+	if strings.HasPrefix(c.DSN, "postgres://") || strings.HasPrefix(c.DSN, "postgresql://") {
+		if len(params) > 0 {
+			return "", errors.New("postgres URL DSN cannot be combined with other postgres settings")
+		}
+		return c.DSN, nil
+	}
+	if c.DSN == "" && len(params) == 0 {
+		environment := false
+		for _, name := range postgresEnvironment {
+			if os.Getenv(name) != "" {
+				environment = true
+			}
+		}
+		if !environment {
+			if runtime.GOOS == "linux" {
+				return "user=ctdownloader dbname=ctdownload sslmode=disable host=/var/run/postgresql", nil
+			}
+			return "user=ctdownloader dbname=ctdownload sslmode=disable", nil
+		}
+	}
+	if c.DSN != "" {
+		params = append([]string{c.DSN}, params...)
+	}
+	return strings.Join(params, " "), nil
+}
+
 func main() {
 	initLogger()
 
@@ -63,6 +148,9 @@ Options:
 	var rows int
 	var memProfile, cpuProfile bool
 	flag.IntVar(&rows, "r", 1000, "number of rows to add")
+	var dsn, postgresConfigFile string
+	flag.StringVar(&dsn, "postgres-dsn", "", "postgres connection string (default: local ctdownload socket, or the libpq PGHOST, PGUSER, ... environment variables)")
+	flag.StringVar(&postgresConfigFile, "postgres-config", "", "JSON file with postgres connection settings, as for ctsync-pull")
 	flag.BoolVar(&memProfile, "mem-profile", false, "run memory profiling")
 	flag.BoolVar(&cpuProfile, "cpu-profile", false, "run cpu profiling")
 
@@ -79,10 +167,22 @@ Options:
 		defer profile.Start(profile.MemProfile, profile.ProfilePath("."), profile.NoShutdownHook).Stop()
 	}
 
-	cmdString := "user=ctdownloader dbname=ctdownload sslmode=disable"
-
-	if runtime.GOOS == "linux" {
-		cmdString = "user=ctdownloader dbname=ctdownload sslmode=disable host=/var/run/postgresql"
+	var config postgresConfig
+	if postgresConfigFile != "" {
+		contents, err := ioutil.ReadFile(postgresConfigFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := json.Unmarshal(contents, &config); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if dsn != "" {
+		config.DSN = dsn
+	}
+	cmdString, err := config.connectionString()
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	db, err := sql.Open("postgres", cmdString)